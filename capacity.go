@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"text/tabwriter"
+
+	"stuffer/steg"
+)
+
+// payloadSizes holds the maximum data size for each way of storing it
+type payloadSizes struct {
+	Hashed    int64 `json:"hashed"`
+	NoHash    int64 `json:"no_hash"`
+	Encrypted int64 `json:"encrypted"`
+}
+
+type layoutCapacity struct {
+	Bits     int          `json:"bits"`
+	Alpha    bool         `json:"alpha"`
+	Capacity int          `json:"capacity"`
+	Payload  payloadSizes `json:"max_payload"`
+	// estimated maximum size of the data with compression, only if a data file was given
+	Compressed *payloadSizes `json:"max_payload_compressed,omitempty"`
+}
+
+type capacityReport struct {
+	Image          string           `json:"image"`
+	Width          int              `json:"width"`
+	Height         int              `json:"height"`
+	Type           string           `json:"type"`
+	DataFile       string           `json:"data_file,omitempty"`
+	DataSize       int64            `json:"data_size,omitempty"`
+	CompressedSize int64            `json:"compressed_size,omitempty"`
+	KeyType        string           `json:"key_type"`
+	KeyBits        int              `json:"key_bits"`
+	Layouts        []layoutCapacity `json:"layouts"`
+}
+
+func runCapacity(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("capacity", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	dataFile := fs.String("data", "", "data file used to estimate how well the data compresses (-z)")
+	keyTypeName := fs.String("key-type", "rsa", "type of the key used for the encrypted size: rsa, x25519, p256 or passphrase")
+	keyBits := fs.Int("key-size", steg.RSA_KEY_BITS, "size of the RSA key in bits used for the encrypted size")
+	keyFile := fs.String("k", "", "public key file, its type and size are used for the encrypted size instead of -key-type and -key-size")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s capacity [flags] <image>\n", programName())
+		fmt.Fprintln(os.Stderr, "prints how many bytes of data the image can hold for every layout and mode")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	im, _, err := loadImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	keyType, err := steg.ParseKeyType(*keyTypeName)
+	if err != nil {
+		return err
+	}
+	if *keyFile != "" {
+		pub, err := steg.LoadPublicKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		if keyType, err = steg.PublicKeyType(pub); err != nil {
+			return err
+		}
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+			*keyBits = rsaPub.Size() * 8
+		}
+	}
+	if keyType != steg.KEY_RSA {
+		// elliptic curve keys have a fixed size
+		*keyBits = 256
+	}
+	report := &capacityReport{
+		Image:   fs.Arg(0),
+		Width:   im.Bounds().Dx(),
+		Height:  im.Bounds().Dy(),
+		Type:    fmt.Sprintf("%T", im),
+		KeyType: keyType.String(),
+		KeyBits: *keyBits,
+	}
+	if *dataFile != "" {
+		fData, err := os.Open(*dataFile)
+		if err != nil {
+			return err
+		}
+		defer fData.Close()
+		stat, err := fData.Stat()
+		if err != nil {
+			return err
+		}
+		report.DataFile = *dataFile
+		report.DataSize = stat.Size()
+		if report.CompressedSize, err = steg.CompressedSize(fData); err != nil {
+			return fmt.Errorf("failed to compress data: %s", err.Error())
+		}
+	}
+	if err = report.measure(im, keyType); err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	report.print()
+	return nil
+}
+
+// measure fills in the capacity of every layout the image supports
+func (r *capacityReport) measure(im image.Image, keyType steg.KeyType) error {
+	for bits := 1; bits <= steg.MAX_BITS; bits++ {
+		for _, alpha := range []bool{false, true} {
+			layout := steg.Layout{Bits: bits, Alpha: alpha}
+			capacity, err := steg.Capacity(im, layout)
+			if err != nil {
+				// the image does not support this layout
+				continue
+			}
+			lc := layoutCapacity{Bits: bits, Alpha: alpha, Capacity: capacity}
+			if err = lc.Payload.fill(capacity, keyType, r.KeyBits); err != nil {
+				return err
+			}
+			if r.CompressedSize > 0 {
+				// assume the data compresses as well as the sample does
+				lc.Compressed = &payloadSizes{
+					Hashed:    lc.Payload.Hashed * r.DataSize / r.CompressedSize,
+					NoHash:    lc.Payload.NoHash * r.DataSize / r.CompressedSize,
+					Encrypted: lc.Payload.Encrypted * r.DataSize / r.CompressedSize,
+				}
+			}
+			r.Layouts = append(r.Layouts, lc)
+		}
+	}
+	if len(r.Layouts) == 0 {
+		return fmt.Errorf("%w: the image cannot hold any data", steg.ErrUnsupportedImage)
+	}
+	return nil
+}
+
+func (ps *payloadSizes) fill(capacity int, keyType steg.KeyType, keyBits int) error {
+	sizes := []struct {
+		size    *int64
+		hashed  bool
+		keyType steg.KeyType
+	}{
+		{&ps.Hashed, true, 0},
+		{&ps.NoHash, false, 0},
+		{&ps.Encrypted, true, keyType},
+	}
+	for _, s := range sizes {
+		n, err := steg.MaxPayload(capacity, s.hashed, s.keyType, keyBits)
+		if err != nil {
+			return err
+		}
+		*s.size = int64(n)
+	}
+	return nil
+}
+
+func (r *capacityReport) print() {
+	fmt.Printf("%s: %dx%d %s\n", r.Image, r.Width, r.Height, r.Type)
+	if r.DataFile != "" {
+		fmt.Printf("%s: %dB, %dB compressed\n", r.DataFile, r.DataSize, r.CompressedSize)
+	}
+	fmt.Println("maximum data size in bytes:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	key := r.KeyType
+	if r.KeyType == steg.KEY_RSA.String() {
+		key = fmt.Sprintf("%s %d bit", r.KeyType, r.KeyBits)
+	}
+	flag := "-k"
+	if r.KeyType == steg.KEY_PASSPHRASE.String() {
+		flag = "-p"
+	}
+	header := fmt.Sprintf("layout\tcapacity\thashed\tno hash (-nh)\tencrypted (%s, %s)", flag, key)
+	if r.DataFile != "" {
+		header += "\thashed -z\tno hash -z\tencrypted -z"
+	}
+	fmt.Fprintln(tw, header)
+	for _, lc := range r.Layouts {
+		line := fmt.Sprintf("%s\t%d\t%d\t%d\t%d", steg.Layout{Bits: lc.Bits, Alpha: lc.Alpha}, lc.Capacity, lc.Payload.Hashed, lc.Payload.NoHash, lc.Payload.Encrypted)
+		if lc.Compressed != nil {
+			line += fmt.Sprintf("\t~%d\t~%d\t~%d", lc.Compressed.Hashed, lc.Compressed.NoHash, lc.Compressed.Encrypted)
+		}
+		fmt.Fprintln(tw, line)
+	}
+	tw.Flush()
+}
@@ -1,3 +1,5 @@
 module stuffer
 
-go 1.23
+go 1.24.0
+
+require golang.org/x/crypto v0.45.0
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"stuffer/steg"
+)
+
+type inspectReport struct {
+	Image      string     `json:"image"`
+	Version    int        `json:"version"`
+	Bits       int        `json:"bits"`
+	Alpha      bool       `json:"alpha"`
+	Hashed     bool       `json:"hashed"`
+	Encrypted  bool       `json:"encrypted"`
+	Compressed bool       `json:"compressed"`
+	Signed     bool       `json:"signed"`
+	KeyType    string     `json:"key_type,omitempty"`
+	KeyBits    int        `json:"key_bits,omitempty"`
+	KeySlots   int        `json:"key_slots,omitempty"`
+	MatrixBits int        `json:"matrix_bits,omitempty"`
+	LegacyRSA  bool       `json:"legacy_rsa,omitempty"`
+	Length     *uint32    `json:"length,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	Extension  string     `json:"extension,omitempty"`
+	Timestamp  *time.Time `json:"timestamp,omitempty"`
+}
+
+func runInspect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	keyFile := fs.String("k", "", "private key file, required to see the details of encrypted data")
+	keyPassFile := fs.String("kp", "", "file containing the passphrase of the private key, if it is protected by one")
+	shuffleSeed := fs.String("ss", "", "shuffle seed, required if the data was shuffled")
+	noHash := fs.Bool("nh", false, "the data is not hashed. only required for images in the legacy layout")
+	passphrase := fs.String("p", "", "passphrase the data was encrypted with")
+	passFile := fs.String("pass-file", "", "file containing the passphrase the data was encrypted with")
+	legacyRSA := fs.Bool("legacy-rsa", false, "allow decrypting data that uses RSA PKCS#1 v1.5 padding, written by older versions of stuffer without a container header")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect [flags] <image>\n", programName())
+		fmt.Fprintln(os.Stderr, "prints the metadata of the hidden data without extracting it")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	opts := steg.Options{ShuffleSeed: *shuffleSeed, NoHash: *noHash, LegacyRSA: *legacyRSA}
+	var err error
+	if *keyFile != "" {
+		if opts.PrivateKey, err = loadPrivateKey(*keyFile, *keyPassFile); err != nil {
+			return err
+		}
+	}
+	if opts.Passphrase, err = dataPassphrase(*passphrase, *passFile); err != nil {
+		return err
+	}
+	im, _, err := loadImage(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	meta, err := steg.Inspect(ctx, im, opts)
+	if errors.Is(err, steg.ErrLegacyRSA) {
+		return fmt.Errorf("%s (-legacy-rsa)", err.Error())
+	} else if err != nil {
+		return err
+	}
+	report := &inspectReport{
+		Image:      fs.Arg(0),
+		Version:    meta.Version,
+		Bits:       meta.Layout.Bits,
+		Alpha:      meta.Layout.Alpha,
+		Hashed:     meta.Hashed,
+		Encrypted:  meta.Encrypted,
+		Compressed: meta.Compressed,
+		Signed:     meta.Signed,
+		KeyBits:    meta.KeyBits,
+		KeySlots:   meta.KeySlots,
+		MatrixBits: meta.MatrixBits,
+		LegacyRSA:  meta.LegacyRSA,
+		Hash:       hex.EncodeToString(meta.Hash),
+		Extension:  meta.Extension,
+	}
+	// the details of encrypted data are unknown without the private key
+	details := !meta.Encrypted || opts.PrivateKey != nil || opts.Passphrase != nil
+	if details {
+		report.Length = &meta.Length
+	}
+	if meta.KeyType != 0 {
+		report.KeyType = meta.KeyType.String()
+	}
+	if meta.Encrypted && details {
+		report.Timestamp = &meta.Timestamp
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	report.print()
+	return nil
+}
+
+func (r *inspectReport) print() {
+	fmt.Printf("image: %s\n", r.Image)
+	if r.Version == 0 {
+		fmt.Println("version: legacy layout without header")
+	} else {
+		fmt.Printf("version: %d\n", r.Version)
+	}
+	fmt.Printf("layout: %s\n", steg.Layout{Bits: r.Bits, Alpha: r.Alpha})
+	var flags []string
+	if r.Hashed {
+		flags = append(flags, "hashed")
+	}
+	if r.Encrypted {
+		flags = append(flags, "encrypted")
+	}
+	if r.Compressed {
+		flags = append(flags, "compressed")
+	}
+	if r.Signed {
+		flags = append(flags, "signed")
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "none")
+	}
+	fmt.Printf("flags: %s\n", strings.Join(flags, ", "))
+	if r.KeySlots > 0 {
+		fmt.Printf("key slots: %d\n", r.KeySlots)
+	}
+	if r.MatrixBits > 0 {
+		fmt.Printf("matrix embedding: %d data bits per %d color bits\n", r.MatrixBits, 1<<r.MatrixBits-1)
+	}
+	if r.Encrypted {
+		switch {
+		case r.KeyType == "":
+			fmt.Println("key: unknown, it is only known once the private key (-k) or passphrase (-p) decrypted one of the key slots")
+		case r.KeyType == steg.KEY_PASSPHRASE.String():
+			fmt.Printf("key: %s\n", r.KeyType)
+			fmt.Println("key wrap: scrypt")
+		case r.KeyType != steg.KEY_RSA.String():
+			fmt.Printf("key: %s\n", r.KeyType)
+			fmt.Println("key wrap: ephemeral ECDH, HKDF-SHA256")
+		case r.LegacyRSA:
+			fmt.Printf("key: %s %d bit\n", r.KeyType, r.KeyBits)
+			fmt.Println("key wrap: RSA PKCS#1 v1.5 (legacy, decrypting it requires -legacy-rsa)")
+		default:
+			fmt.Printf("key: %s %d bit\n", r.KeyType, r.KeyBits)
+			fmt.Println("key wrap: RSA-OAEP-SHA256")
+		}
+	}
+	if r.Length == nil {
+		fmt.Println("the data is encrypted, the private key (-k) or passphrase (-p) is required to see its length, hash, extension and timestamp")
+		return
+	}
+	fmt.Printf("length: %dB\n", *r.Length)
+	if r.Hash != "" {
+		fmt.Printf("hash: %s\n", r.Hash)
+	}
+	if r.Encrypted {
+		fmt.Printf("extension: %s\n", r.Extension)
+		fmt.Printf("timestamp: %s\n", r.Timestamp.String())
+	}
+	if r.Signed {
+		fmt.Println("the signature is inside the encrypted data, decode the image with -verify-from to check it")
+	}
+}
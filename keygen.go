@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stuffer/steg"
+)
+
+func runKeygen(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	name := fs.String("o", "", "output name, the keys are written to <name>_private.pem and <name>_public.pem")
+	algorithm := fs.String("alg", "rsa", "key algorithm: rsa, x25519 or p256. the elliptic curve keys are much smaller and take less space in the image. "+
+		"ed25519 generates a key pair for signing the data (-sign, -verify-from)")
+	size := fs.Int("size", steg.RSA_KEY_BITS, "RSA key size in bits")
+	passFile := fs.String("kp", "", "file containing a passphrase to protect the private key with, use /dev/stdin to pipe it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s keygen [flags] -o <name>\n", programName())
+		fmt.Fprintln(os.Stderr, "generates a key pair for encrypting data with -k or signing it with -sign")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *name == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var passphrase []byte
+	var err error
+	if *passFile != "" {
+		if passphrase, err = readPassphrase(*passFile); err != nil {
+			return err
+		}
+	}
+	var key crypto.PrivateKey
+	var pub crypto.PublicKey
+	if strings.EqualFold(*algorithm, "ed25519") {
+		key, pub, err = steg.GenerateSigningKey()
+	} else {
+		var keyType steg.KeyType
+		if keyType, err = steg.ParseKeyType(*algorithm); err != nil {
+			return err
+		}
+		key, pub, err = steg.GenerateKey(keyType, *size)
+	}
+	if err != nil {
+		return err
+	}
+	privData, err := steg.MarshalPrivateKeyPEM(key, passphrase)
+	if err != nil {
+		return err
+	}
+	pubData, err := steg.MarshalPublicKeyPEM(pub)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := steg.Fingerprint(pub)
+	if err != nil {
+		return err
+	}
+	privPath, pubPath := *name+"_private.pem", *name+"_public.pem"
+	if err = writeNewFile(privPath, privData, 0600); err != nil {
+		return err
+	}
+	if err = writeNewFile(pubPath, pubData, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("private key: %s\n", privPath)
+	fmt.Printf("public key: %s\n", pubPath)
+	fmt.Printf("fingerprint: %s\n", fingerprint)
+	return nil
+}
+
+// writeNewFile writes the data to a file that must not exist yet, so that keys are never overwritten
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readPassphrase reads a passphrase from the first line of the file
+func readPassphrase(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the passphrase: %s", err.Error())
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		data = data[:i]
+	}
+	if len(data) == 0 {
+		return nil, errors.New("the passphrase is empty")
+	}
+	return data, nil
+}
+
+// dataPassphrase returns the passphrase for encrypting the data, given directly or in a file
+func dataPassphrase(passphrase string, passFile string) ([]byte, error) {
+	if passphrase != "" && passFile != "" {
+		return nil, errors.New("-p and -pass-file cannot be used together")
+	}
+	if passFile != "" {
+		return readPassphrase(passFile)
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// loadPrivateKey loads the private key, reading its passphrase from passFile if it is protected by one
+func loadPrivateKey(keyFile string, passFile string) (crypto.PrivateKey, error) {
+	return loadProtectedKey(steg.LoadPrivateKeyWithPassphrase, keyFile, passFile)
+}
+
+// loadSigningKey loads the private key of -sign, reading its passphrase from passFile if it is protected by one
+func loadSigningKey(keyFile string, passFile string) (crypto.PrivateKey, error) {
+	return loadProtectedKey(steg.LoadSigningKey, keyFile, passFile)
+}
+
+func loadProtectedKey(load func(string, []byte) (crypto.PrivateKey, error), keyFile string, passFile string) (crypto.PrivateKey, error) {
+	var passphrase []byte
+	if passFile != "" {
+		var err error
+		if passphrase, err = readPassphrase(passFile); err != nil {
+			return nil, err
+		}
+	}
+	key, err := load(keyFile, passphrase)
+	if errors.Is(err, steg.ErrPassphraseRequired) {
+		return nil, fmt.Errorf("%s, pass a file containing it with -kp", err.Error())
+	}
+	return key, err
+}
+
+// loadPublicKeys loads the public keys of all recipients, a directory adds every .pem file in it
+func loadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		files := []string{path}
+		if stat, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if stat.IsDir() {
+			if files, err = filepath.Glob(filepath.Join(path, "*.pem")); err != nil {
+				return nil, err
+			}
+			if len(files) == 0 {
+				return nil, fmt.Errorf("no .pem files found in %s", path)
+			}
+		}
+		for _, file := range files {
+			key, err := steg.LoadPublicKey(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -1,53 +1,126 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/binary"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
+	_ "image/jpeg"
 	"image/png"
 	"io"
-	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"stuffer/steg"
 )
 
 type Program struct {
 	verbose     bool
 	doHash      bool
+	compress    bool
 	decode      bool
+	bits        int
+	alpha       bool
 	shuffleSeed string
+	scatter     bool
+	fill        string
+	matching    bool
+	matrix      bool
 	inputImage  string
 	dataFile    string
 	outputImage string
-	keyFile     string
+	keyFiles    stringList
+	keyPassFile string
+	passphrase  string
+	passFile    string
+	legacyRSA   bool
+	signFile    string
+	verifyFile  string
+	replayDB    string
+	replayWin   time.Duration
+	replayWarn  bool
 }
 
-const HASH_SIZE = sha256.Size
-const FSIZE_LEN = 4
-const TIMESTAMP_LEN = 8
-const RSA_SIZE = 256
+// stringList is a flag that can be given multiple times
+type stringList []string
 
-func ShortUsage() {
-	programName := "stuffer"
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ", ")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// commands are run as "stuffer <command> [flags] <args>", without a command the flags select between encoding and decoding
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"capacity": runCapacity,
+	"inspect":  runInspect,
+	"verify":   runVerify,
+	"keygen":   runKeygen,
+}
+
+func programName() string {
 	if ex, err := os.Executable(); err == nil {
-		programName = filepath.Base(ex)
+		return filepath.Base(ex)
 	}
+	return "stuffer"
+}
+
+func ShortUsage() {
+	programName := programName()
 	fmt.Fprintf(os.Stderr, "%s is a program for embedding hidden data in images\n", programName)
 	fmt.Fprintf(os.Stderr, "Encode usage: %s [flags] <input_image> <input_data_file> <output_image>\n", programName)
 	fmt.Fprintf(os.Stderr, "Decode usage: %s [flags] <input_image> <output_data_file>\n", programName)
+	fmt.Fprintf(os.Stderr, "Capacity usage: %s capacity [flags] <image>\n", programName)
+	fmt.Fprintf(os.Stderr, "Inspect usage: %s inspect [flags] <image>\n", programName)
+	fmt.Fprintf(os.Stderr, "Verify usage: %s verify [flags] <image> <file>\n", programName)
+	fmt.Fprintf(os.Stderr, "Keygen usage: %s keygen [flags] -o <name>\n", programName)
+}
+
+func loadImage(path string) (image.Image, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	im, format, err := image.Decode(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read input image: %s", err.Error())
+	}
+	return im, format, nil
 }
 
 func ProgramFromArgs() *Program {
 	p := &Program{}
 	var noHash bool
 	flag.BoolVar(&p.verbose, "v", false, "verbose output")
-	flag.BoolVar(&noHash, "nh", false, "do not calculate the file hash")
+	flag.BoolVar(&noHash, "nh", false, "do not calculate the file hash. only required when decoding images in the legacy layout")
+	flag.BoolVar(&p.compress, "z", false, "compress the data before embedding it")
+	flag.IntVar(&p.bits, "bits", 1, fmt.Sprintf("number of least significant bits of each color channel used for the data (1-%d). more bits increase the capacity, but also the visible noise", steg.MAX_BITS))
+	flag.BoolVar(&p.alpha, "alpha", false, "also use the alpha channel for the data. fully transparent pixels are skipped")
 	flag.BoolVar(&p.decode, "d", false, "decode the image instead of encode")
 	flag.StringVar(&p.shuffleSeed, "ss", "", "shuffle seed, set this if you want to shuffle the data, also required when decoding")
-	flag.StringVar(&p.keyFile, "k", "", "RSA key file. set this if you wish to encrypt the data. public key is used for encoding, private for decoding")
+	flag.BoolVar(&p.scatter, "scatter", false, "with -ss, only change the bits holding the data instead of shuffling the bits of the whole image. decoding detects it")
+	flag.StringVar(&p.fill, "fill", "none", "fill the capacity behind the data with noise, so the end of the data cannot be seen in the image: none, random or cover (random bits with the share of ones of the replaced bits)")
+	flag.BoolVar(&p.matching, "match", false, "change the color values by one up or down instead of replacing their lowest bit (LSB matching), which is harder to detect")
+	flag.BoolVar(&p.matrix, "matrix", false, "store the data with matrix embedding, which changes far fewer color values if the data is small compared to the capacity. decoding detects it")
+	flag.Var(&p.keyFiles, "k", "key file (RSA, X25519 or P-256). set this if you wish to encrypt the data. public key is used for encoding, private for decoding encrypted images. "+
+		"repeat it or pass a directory of public keys to encrypt the data for several recipients")
+	flag.StringVar(&p.keyPassFile, "kp", "", "file containing the passphrase of the private key, if it is protected by one. use /dev/stdin to pipe it")
+	flag.StringVar(&p.passphrase, "p", "", "passphrase to encrypt the data with, instead of or in addition to -k. it is visible to other users of the system, prefer -pass-file")
+	flag.StringVar(&p.passFile, "pass-file", "", "file containing the passphrase to encrypt the data with, use /dev/stdin to pipe it")
+	flag.StringVar(&p.signFile, "sign", "", "private key file (Ed25519 or RSA) to sign the encrypted data with, so the recipients can check who sent it. use -kp for its passphrase")
+	flag.StringVar(&p.verifyFile, "verify-from", "", "public key file of the sender, decoding fails unless the data is signed with the matching private key (-sign)")
+	flag.StringVar(&p.replayDB, "replay-db", "", "file remembering the decoded encrypted images, decoding fails for images that were decoded before or whose timestamp is outside of -replay-window")
+	flag.DurationVar(&p.replayWin, "replay-window", DEFAULT_REPLAY_WINDOW, "maximum age of encrypted images accepted with -replay-db, 0 accepts images of any age")
+	flag.BoolVar(&p.replayWarn, "replay-warn", false, "only print a warning for replayed images instead of failing (-replay-db)")
+	flag.BoolVar(&p.legacyRSA, "legacy-rsa", false, "allow decrypting images encrypted by older versions of stuffer without a container header, which use RSA PKCS#1 v1.5 padding. only use it for images from trusted sources")
 	flag.Parse()
 	p.doHash = !noHash
 
@@ -80,34 +153,100 @@ func ProgramFromArgs() *Program {
 	return p
 }
 
-func (p *Program) run() error {
+// options returns the library options matching the flags, loading the key if one was given
+func (p *Program) options() (steg.Options, error) {
+	opts := steg.Options{
+		Bits:        p.bits,
+		Alpha:       p.alpha,
+		NoHash:      !p.doHash,
+		Compress:    p.compress,
+		ShuffleSeed: p.shuffleSeed,
+		Scatter:     p.scatter,
+		Matching:    p.matching,
+		Matrix:      p.matrix,
+		Extension:   filepath.Ext(p.dataFile),
+		LegacyRSA:   p.legacyRSA,
+	}
+	if p.verbose {
+		opts.Log = os.Stdout
+	}
+	var err error
+	if opts.Fill, err = steg.ParseFillMode(p.fill); err != nil {
+		return opts, err
+	}
+	if (opts.Fill != steg.FILL_NONE || opts.Matching || opts.Matrix) && p.decode {
+		return opts, errors.New("-fill, -match and -matrix are only used for encoding")
+	}
+	if opts.Passphrase, err = dataPassphrase(p.passphrase, p.passFile); err != nil {
+		return opts, err
+	}
+	if p.signFile != "" {
+		if p.decode {
+			return opts, errors.New("-sign is only used for encoding, use -verify-from to check the signature when decoding")
+		}
+		if opts.SigningKey, err = loadSigningKey(p.signFile, p.keyPassFile); err != nil {
+			return opts, err
+		}
+	}
+	if p.replayDB != "" && !p.decode {
+		return opts, errors.New("-replay-db is only used for decoding")
+	}
+	if p.verifyFile != "" {
+		if !p.decode {
+			return opts, errors.New("-verify-from is only used for decoding, use -sign to sign the data when encoding")
+		}
+		if opts.VerifyKey, err = steg.LoadVerifyKey(p.verifyFile); err != nil {
+			return opts, err
+		}
+	}
+	if len(p.keyFiles) == 0 {
+		return opts, nil
+	}
+	if p.decode {
+		if len(p.keyFiles) > 1 {
+			return opts, errors.New("only one private key (-k) can be used for decoding")
+		}
+		if p.verbose {
+			fmt.Println("loading private key")
+		}
+		opts.PrivateKey, err = loadPrivateKey(p.keyFiles[0], p.keyPassFile)
+	} else {
+		if p.verbose {
+			fmt.Println("loading public keys")
+		}
+		opts.Recipients, err = loadPublicKeys(p.keyFiles)
+	}
+	return opts, err
+}
+
+func (p *Program) run(ctx context.Context) error {
 	if p.decode {
-		return p.runDecode()
+		return p.runDecode(ctx)
 	} else {
-		return p.runEncode()
+		return p.runEncode(ctx)
 	}
 }
 
-func (p *Program) runEncode() error {
-	fInputImage, err := os.Open(p.inputImage)
+func (p *Program) runEncode(ctx context.Context) error {
+	opts, err := p.options()
 	if err != nil {
 		return err
 	}
-	defer fInputImage.Close()
 	fData, err := os.Open(p.dataFile)
 	if err != nil {
 		return err
 	}
 	defer fData.Close()
-	im, format, err := image.Decode(fInputImage)
+	im, format, err := loadImage(p.inputImage)
 	if err != nil {
-		return fmt.Errorf("failed to read input image: %s", err.Error())
+		return err
 	}
 	if p.verbose {
 		fmt.Printf("read input image of format '%s'\n", format)
 		fmt.Println("encoding ...")
 	}
-	if err = p.encodeImage(im, filepath.Ext(p.dataFile), fData); err != nil {
+	out, err := steg.Encode(ctx, im, fData, opts)
+	if err != nil {
 		return err
 	}
 	fOut, err := os.Create(p.outputImage)
@@ -115,223 +254,104 @@ func (p *Program) runEncode() error {
 		return err
 	}
 	defer fOut.Close()
-	if err = png.Encode(fOut, im); err != nil {
+	if err = png.Encode(fOut, out); err != nil {
 		return fmt.Errorf("failed to encode output image: %s", err.Error())
 	}
 	fmt.Println("Success")
 	return nil
 }
 
-func (p *Program) runDecode() error {
-	fInputImage, err := os.Open(p.inputImage)
+func (p *Program) runDecode(ctx context.Context) error {
+	opts, err := p.options()
 	if err != nil {
 		return err
 	}
-	defer fInputImage.Close()
-	fData, err := os.Create(p.dataFile)
-	if err != nil {
-		return err
+	var db *replayDB
+	if p.replayDB != "" {
+		if db, err = openReplayDB(ctx, p.replayDB, p.replayWin); err != nil {
+			return err
+		}
+		defer db.close()
 	}
-	defer fData.Close()
-	im, format, err := image.Decode(fInputImage)
+	im, format, err := loadImage(p.inputImage)
 	if err != nil {
-		return fmt.Errorf("failed to read input image: %s", err.Error())
+		return err
 	}
 	if p.verbose {
 		fmt.Printf("read input image of format '%s'\n", format)
 		fmt.Println("decoding ...")
 	}
-	if err = p.decodeImage(im, fData); err != nil {
+	payload, meta, err := steg.Decode(ctx, im, opts)
+	if errors.Is(err, steg.ErrKeyRequired) {
+		return fmt.Errorf("%s (-k, -p or -pass-file)", err.Error())
+	} else if errors.Is(err, steg.ErrLegacyRSA) {
+		return fmt.Errorf("%s (-legacy-rsa)", err.Error())
+	} else if err != nil {
 		return err
 	}
-	fmt.Println("Success")
-	return nil
-}
-
-func (p *Program) decodeImage(im image.Image, data io.Writer) error {
-	hiddenData, err := GetHiddenBytesFromImage(im)
-	if err != nil {
-		return fmt.Errorf("failed to get hidden data from image: %s", err.Error())
+	if meta.Encrypted {
+		fmt.Printf("decoding successful, got info:\nHash: %x\nExtension: %s\nTimestamp: %s\n", meta.Hash, meta.Extension, meta.Timestamp.String())
 	}
-	// handle shuffle seed
-	if p.shuffleSeed != "" {
-		if p.verbose {
-			fmt.Println("unshuffling data")
-		}
-		indexes := make([]int, len(hiddenData))
-		for i := range indexes {
-			indexes[i] = i
-		}
-		passwordHash := sha256.Sum256([]byte(p.shuffleSeed))
-		for i := 0; i < 4; i++ {
-			seed := int64(binary.BigEndian.Uint64(passwordHash[(i * 8) : (i*8)+8]))
-			r := rand.New(rand.NewSource(seed))
-			r.Shuffle(len(indexes), func(i, j int) {
-				indexes[i], indexes[j] = indexes[j], indexes[i]
-			})
-		}
-		for newidx, oldidx := range indexes {
-			for newidx != oldidx {
-				hiddenData[newidx], hiddenData[oldidx] = hiddenData[oldidx], hiddenData[newidx]
-				indexes[newidx], indexes[oldidx] = indexes[oldidx], indexes[newidx]
-				oldidx = indexes[newidx]
-			}
-		}
+	if meta.SignatureVerified {
+		fmt.Printf("Signature: %s, verified\n", meta.Signature)
+	} else if meta.Signed {
+		fmt.Printf("Signature: %s, not verified, pass the public key of the sender with -verify-from\n", meta.Signature)
 	}
-
-	// handle encryption case
-	if p.keyFile != "" {
-		if p.verbose {
-			fmt.Println("decrypting data")
+	var replayKeyName string
+	now := time.Now()
+	if db != nil {
+		if !meta.Encrypted {
+			return errors.New("-replay-db only works for encrypted images, others have no timestamp")
 		}
-		pos := len(hiddenData) - RSA_SIZE
-		dataBlock, tailBlock := hiddenData[:pos], hiddenData[pos:]
-		plainData, info, err := decryptDataWithRSA(p.keyFile, p.verbose, dataBlock, tailBlock)
-		if err != nil {
+		if replayKeyName, err = replayKey(opts, meta); err != nil {
 			return err
 		}
-		fmt.Printf("decoding successful, got info:\nHash: %x\nExtension: %s\nTimestamp: %s\n", info.hash, info.extension, info.timestamp.String())
-		if p.doHash {
-			if p.verbose {
-				fmt.Println("checking hash")
-			}
-			hashCmp := sha256.Sum256(plainData)
-			if !bytes.Equal(info.hash, hashCmp[:]) {
-				return fmt.Errorf("hash check failed (%x)", hashCmp)
-			}
-		}
-		if n, err := data.Write(plainData); err != nil {
-			return fmt.Errorf("failed to write data to the file (%d out of %d bytes written): %s", n, len(plainData), err.Error())
-		}
-		return nil
-	}
-
-	// length
-	lenStart := len(hiddenData) - HASH_SIZE - FSIZE_LEN
-	dataLength := binary.BigEndian.Uint32(hiddenData[lenStart : lenStart+FSIZE_LEN])
-	if dataLength == 0 {
-		return fmt.Errorf("data length is zero")
-	}
-	if dataLength > uint32(lenStart) {
-		return fmt.Errorf("length is too large: %d > %d", dataLength, lenStart)
-	}
-
-	// hash check
-	if p.doHash {
-		if p.verbose {
-			fmt.Println("checking hash")
-		}
-		checksum := sha256.Sum256(hiddenData[:dataLength])
-		hashStart := len(hiddenData) - HASH_SIZE
-		if !bytes.Equal(checksum[:], hiddenData[hashStart:]) {
-			return fmt.Errorf("data hash verification failed")
+		if err = db.check(replayKeyName, meta, now); err != nil && !p.replayWarn {
+			return fmt.Errorf("%s, use -replay-warn to decode it anyway", err.Error())
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", err.Error())
 		}
 	}
-
-	if n, err := data.Write(hiddenData[:dataLength]); err != nil {
-		return fmt.Errorf("failed to write data to the file (%d out of %d bytes written): %s", n, dataLength, err.Error())
-	}
-	return nil
-}
-
-func (p *Program) encodeImage(im image.Image, extension string, data io.ReadSeeker) error {
-	wi, ok := im.(WritableImage)
-	if !ok {
-		return fmt.Errorf("cannot edit the image pixels")
-	}
-	ibw, err := NewImageByteWriter(wi)
-	if err != nil {
-		return fmt.Errorf("failed to create image byte writer: %s", err.Error())
-	}
-
-	// get data size
-	sz, err := data.Seek(0, io.SeekEnd)
+	fData, err := os.Create(p.dataFile)
 	if err != nil {
-		return fmt.Errorf("failed to get data size: %s", err.Error())
-	}
-	if sz < 0 || sz > int64(^uint32(0)) {
-		return fmt.Errorf("invalid data size: %d", sz)
-	}
-	required := sz + HASH_SIZE + FSIZE_LEN
-	var overhead int
-	if p.keyFile != "" {
-		// take into account additional data if encrypted
-		if overhead, err = calculateRSAOverhead(); err != nil {
-			return fmt.Errorf("failed to get AES128 gcm overhead: %s", err.Error())
-		}
-		required = sz + int64(overhead) + RSA_SIZE
-	}
-
-	if ibw.Capacity() < int(required) {
-		return fmt.Errorf("image capacity is too small. require %dB, but only have %dB", required, ibw.Capacity())
-	}
-	if _, err = data.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
-	hiddenData, err := GetHiddenBytesFromImage(wi)
-	if err != nil {
-		return fmt.Errorf("failed to extract initial image data: %s", err.Error())
-	}
-
-	// copy data
-	if n, err := io.ReadFull(data, hiddenData[:sz]); err != nil {
-		return fmt.Errorf("failed to read desired data into a byte buffer (%d out of %d bytes read): %s", n, sz, err.Error())
-	}
-	// data size
-	dataSize := sz
-	sizePos := len(hiddenData) - HASH_SIZE - FSIZE_LEN
-	binary.BigEndian.PutUint32(hiddenData[sizePos:sizePos+FSIZE_LEN], uint32(dataSize))
-	// hash
-	if p.doHash {
-		hashPos := len(hiddenData) - HASH_SIZE
-		checksum := sha256.Sum256(hiddenData[:sz])
-		copy(hiddenData[hashPos:], checksum[:])
-	}
-
-	// encryption
-	if p.keyFile != "" {
-		if p.verbose {
-			fmt.Println("encrypting data")
-		}
-		encdata, enctail, err := encryptDataWithRSA(p.keyFile, p.verbose, hiddenData[:sz], extension, hiddenData[sizePos:])
-		if err != nil {
+	defer fData.Close()
+	if n, err := io.Copy(fData, payload); err != nil {
+		fData.Close()
+		os.Remove(p.dataFile)
+		if errors.Is(err, steg.ErrHashMismatch) {
 			return err
 		}
-		if len(encdata) > int(dataSize)+overhead {
-			return fmt.Errorf("AES128 encrypted data is of size %d, which is larger than maximum expected size %d", len(encdata), dataSize+int64(overhead))
-		}
-		if len(enctail) != RSA_SIZE {
-			return fmt.Errorf("RSA data is of size %d, not of expected size %d", len(enctail), RSA_SIZE)
-		}
-		copy(hiddenData[:len(encdata)], encdata)
-		copy(hiddenData[len(hiddenData)-RSA_SIZE:], enctail)
+		return fmt.Errorf("failed to write data to the file (%d bytes written): %w", n, err)
 	}
-
-	// shuffle seed
-	if p.shuffleSeed != "" {
-		if p.verbose {
-			fmt.Println("shuffling data")
-		}
-		// hash the password and calculate the random seed
-		passwordHash := sha256.Sum256([]byte(p.shuffleSeed))
-		for i := 0; i < 4; i++ {
-			seed := int64(binary.BigEndian.Uint64(passwordHash[(i * 8) : (i*8)+8]))
-			r := rand.New(rand.NewSource(seed))
-			r.Shuffle(len(hiddenData), func(i, j int) {
-				hiddenData[i], hiddenData[j] = hiddenData[j], hiddenData[i]
-			})
+	if db != nil {
+		// only remember images that were decoded completely
+		if err = db.record(replayKeyName, meta, now); err != nil {
+			return err
 		}
 	}
-
-	// write all of the data to the image
-	if n, err := ibw.Write(hiddenData); err != nil {
-		return fmt.Errorf("failed to write hidden data to the image (%d out of %d bytes written): %s", n, len(hiddenData), err.Error())
-	}
+	fmt.Println("Success")
 	return nil
 }
 
 func main() {
-	if err := ProgramFromArgs().run(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(ctx, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				var ee *exitError
+				if errors.As(err, &ee) {
+					os.Exit(ee.code)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if err := ProgramFromArgs().run(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
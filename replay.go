@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"stuffer/steg"
+)
+
+// encrypted images carry the time they were created, the replay database remembers the AES GCM nonce, which is random
+// for every encoded image, and the timestamp of every decoded image per key, so an image cannot be sent to the recipient a second time
+const DEFAULT_REPLAY_WINDOW = 30 * 24 * time.Hour
+
+// timestamps are accepted this far in the future, to allow for clocks that are a bit off
+const REPLAY_CLOCK_SKEW = 5 * time.Minute
+
+// key of images decrypted with a passphrase, there is no public key to identify it
+const REPLAY_PASSPHRASE_KEY = "passphrase"
+
+// the database is locked while an image is decoded, other processes wait this long for the lock
+const REPLAY_LOCK_TIMEOUT = 30 * time.Second
+const REPLAY_LOCK_RETRY = 100 * time.Millisecond
+
+var errReplay = errors.New("possible replay")
+
+type replayEntry struct {
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// replayDB is stored as JSON, the entries are grouped by the fingerprint of the key that decrypted the image.
+// it is locked from openReplayDB until close, so concurrent decodes do not lose each other's entries
+type replayDB struct {
+	path   string
+	lock   string
+	window time.Duration
+	Keys   map[string][]replayEntry `json:"keys"`
+}
+
+// openReplayDB locks and reads the replay database, a missing file is an empty database. a window of 0 accepts images of any age
+func openReplayDB(ctx context.Context, path string, window time.Duration) (*replayDB, error) {
+	lock, err := lockReplayDB(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	db := &replayDB{path: path, lock: lock, window: window, Keys: map[string][]replayEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	} else if err != nil {
+		db.close()
+		return nil, fmt.Errorf("failed to read the replay database: %s", err.Error())
+	}
+	if err = json.Unmarshal(data, db); err != nil {
+		db.close()
+		return nil, fmt.Errorf("failed to parse the replay database %s: %s", path, err.Error())
+	}
+	if db.Keys == nil {
+		db.Keys = map[string][]replayEntry{}
+	}
+	return db, nil
+}
+
+// lockReplayDB creates the lock file next to the database, waiting while another process holds it.
+// the lock file holds the PID of its process, locks left behind by processes that are no longer running are removed
+func lockReplayDB(ctx context.Context, path string) (string, error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(REPLAY_LOCK_TIMEOUT)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return lock, nil
+		} else if !errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to lock the replay database: %s", err.Error())
+		}
+		if removeStaleLock(lock) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("the replay database is locked by another process, remove %s if no other stuffer is running", lock)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(REPLAY_LOCK_RETRY):
+		}
+	}
+}
+
+// removeStaleLock removes the lock file if the process that created it is no longer running. two processes
+// finding the same stale lock at once may both take the lock, which can only happen after a crash
+func removeStaleLock(lock string) bool {
+	data, err := os.ReadFile(lock)
+	if err != nil {
+		// the lock was released in the meantime
+		return errors.Is(err, os.ErrNotExist)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || processRunning(pid) {
+		// the PID is not written yet or the process holds the lock
+		return false
+	}
+	return os.Remove(lock) == nil
+}
+
+// processRunning reports whether the process with the PID is running, if that cannot be told it is assumed to be
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return true
+	}
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// close releases the lock of the database
+func (db *replayDB) close() error {
+	if err := os.Remove(db.lock); err != nil {
+		return fmt.Errorf("failed to unlock the replay database: %s", err.Error())
+	}
+	return nil
+}
+
+// replayKey returns the name of the key that decrypted the image
+func replayKey(opts steg.Options, meta steg.Metadata) (string, error) {
+	if meta.KeyType == steg.KEY_PASSPHRASE {
+		return REPLAY_PASSPHRASE_KEY, nil
+	}
+	priv, ok := opts.PrivateKey.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return "", fmt.Errorf("unsupported private key type %T", opts.PrivateKey)
+	}
+	return steg.Fingerprint(priv.Public())
+}
+
+func newReplayEntry(meta steg.Metadata) replayEntry {
+	return replayEntry{Nonce: hex.EncodeToString(meta.Nonce), Timestamp: meta.Timestamp.Unix()}
+}
+
+// check returns errReplay if the image was decoded before or its timestamp is outside of the window
+func (db *replayDB) check(key string, meta steg.Metadata, now time.Time) error {
+	if meta.Timestamp.After(now.Add(REPLAY_CLOCK_SKEW)) {
+		return fmt.Errorf("%w: the image was created in the future, at %s", errReplay, meta.Timestamp)
+	}
+	if db.window > 0 && now.Sub(meta.Timestamp) > db.window {
+		return fmt.Errorf("%w: the image was created at %s, which is longer ago than %s (-replay-window)", errReplay, meta.Timestamp, db.window)
+	}
+	if slices.Contains(db.Keys[key], newReplayEntry(meta)) {
+		return fmt.Errorf("%w: the image was already decoded, it was created at %s", errReplay, meta.Timestamp)
+	}
+	return nil
+}
+
+// record adds the image to the database and saves it. entries older than the window are dropped,
+// check rejects those images anyway
+func (db *replayDB) record(key string, meta steg.Metadata, now time.Time) error {
+	entry := newReplayEntry(meta)
+	if !slices.Contains(db.Keys[key], entry) {
+		db.Keys[key] = append(db.Keys[key], entry)
+	}
+	if db.window > 0 {
+		oldest := now.Add(-db.window).Unix()
+		for k, entries := range db.Keys {
+			db.Keys[k] = slices.DeleteFunc(entries, func(e replayEntry) bool { return e.Timestamp < oldest })
+			if len(db.Keys[k]) == 0 {
+				delete(db.Keys, k)
+			}
+		}
+	}
+	return db.save()
+}
+
+// save writes the database to a temporary file first, so it is not lost if writing fails
+func (db *replayDB) save() error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := db.path + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write the replay database: %s", err.Error())
+	}
+	if err = os.Rename(tmp, db.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write the replay database: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stuffer/steg"
+)
+
+func TestReplayDB(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "replay.json")
+	now := time.Now()
+	meta := steg.Metadata{Nonce: []byte{1, 2, 3}, Timestamp: now.Add(-time.Hour).Truncate(time.Second)}
+
+	db, err := openReplayDB(ctx, path, DEFAULT_REPLAY_WINDOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.check("key", meta, now); err != nil {
+		t.Fatalf("new image: %s", err)
+	}
+	if err = db.record("key", meta, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image is rejected once it was recorded, also after reopening the database
+	db, err = openReplayDB(ctx, path, DEFAULT_REPLAY_WINDOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	if err = db.check("key", meta, now); !errors.Is(err, errReplay) {
+		t.Errorf("replayed image: got %v", err)
+	}
+	// the same image decrypted with another key and other images are accepted
+	if err = db.check("other key", meta, now); err != nil {
+		t.Errorf("image of another key: %s", err)
+	}
+	other := meta
+	other.Nonce = []byte{4, 5, 6}
+	if err = db.check("key", other, now); err != nil {
+		t.Errorf("other image: %s", err)
+	}
+	// images outside of the window are rejected
+	other.Timestamp = now.Add(-DEFAULT_REPLAY_WINDOW - time.Hour)
+	if err = db.check("key", other, now); !errors.Is(err, errReplay) {
+		t.Errorf("old image: got %v", err)
+	}
+	other.Timestamp = now.Add(REPLAY_CLOCK_SKEW + time.Minute)
+	if err = db.check("key", other, now); !errors.Is(err, errReplay) {
+		t.Errorf("image from the future: got %v", err)
+	}
+}
+
+func TestLockReplayDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	lock := path + ".lock"
+
+	// a lock held by a running process is waited for
+	if err := os.WriteFile(lock, fmt.Appendf(nil, "%d\n", os.Getpid()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*REPLAY_LOCK_RETRY)
+	defer cancel()
+	if _, err := lockReplayDB(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock of a running process: got %v", err)
+	}
+
+	// a lock left behind by a process that exited is taken over
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lock, fmt.Appendf(nil, "%d\n", cmd.Process.Pid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openReplayDB(context.Background(), path, DEFAULT_REPLAY_WINDOW)
+	if err != nil {
+		t.Fatalf("stale lock: %s", err)
+	}
+	data, err := os.ReadFile(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("the lock holds %q instead of the PID of the test", data)
+	}
+	if err = db.close(); err != nil {
+		t.Fatal(err)
+	}
+}
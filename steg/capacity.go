@@ -0,0 +1,76 @@
+package steg
+
+import (
+	"compress/flate"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Capacity returns the number of hidden bytes the image can hold with the layout, including the container header.
+// images which Encode would convert are measured after the conversion
+func Capacity(img image.Image, layout Layout) (int, error) {
+	wi, _ := EnsureWritableImage(img, layout)
+	ibw, err := NewImageByteWriter(wi, layout)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedImage, err.Error())
+	}
+	return ibw.Capacity(), nil
+}
+
+// Overhead returns the number of bytes used next to the data itself, i.e. the container header
+// and for encrypted data the AES GCM tag. keyType is the type of the key used for encryption, 0 if the data
+// is not encrypted, rsaKeyBits is the size of RSA keys. the overhead is for a single recipient
+func Overhead(hashed bool, keyType KeyType, rsaKeyBits int) (int, error) {
+	header := &ContainerHeader{version: containerVersion}
+	if hashed {
+		header.flags |= flagHashed
+	}
+	switch keyType {
+	case 0:
+		return header.Size(), nil
+	case KEY_RSA:
+		if err := checkRSAKeySize(rsaKeyBits); err != nil {
+			return 0, err
+		}
+		header.blockSize = rsaKeyBits / 8
+	case KEY_X25519, KEY_P256:
+		header.blockSize = ecdhBlockSize(keyType.curve())
+	case KEY_PASSPHRASE:
+		header.blockSize = passphraseBlockSize()
+	default:
+		return 0, fmt.Errorf("unknown key type %d", byte(keyType))
+	}
+	header.flags |= flagEncrypted
+	header.slots = 1
+	overhead, err := calculateGCMOverhead()
+	if err != nil {
+		return 0, err
+	}
+	return header.Size() + overhead, nil
+}
+
+// MaxPayload returns the maximum size of the data that fits into the capacity, see Overhead
+func MaxPayload(capacity int, hashed bool, keyType KeyType, rsaKeyBits int) (int, error) {
+	overhead, err := Overhead(hashed, keyType, rsaKeyBits)
+	if err != nil {
+		return 0, err
+	}
+	return max(capacity-overhead, 0), nil
+}
+
+// CompressedSize returns the size of the data after the compression used by Encode
+func CompressedSize(data io.Reader) (int64, error) {
+	cw := &countingWriter{w: io.Discard}
+	fw, err := flate.NewWriter(cw, flate.BestCompression)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(fw, data); err != nil {
+		return 0, err
+	}
+	if err = fw.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
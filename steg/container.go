@@ -0,0 +1,572 @@
+package steg
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	randv2 "math/rand/v2"
+	"slices"
+	"strings"
+)
+
+const hashSize = sha256.Size
+const fsizeLen = 4
+const timestampLen = 8
+
+// supported RSA key sizes, the RSA block is as large as the key's modulus
+const minRSAKeyBits = 2048
+const maxRSAKeyBits = 8192
+
+// the container header is stored at the beginning of the hidden data and looks like this:
+// [salt, magic, version, flags, layout, length, hash] for plain data
+// [salt, magic, version, flags, layout, key slot count, key slot size, key slots, sealed tail] for encrypted data, every key slot
+// holds the data key encrypted for one recipient, which then opens the tail (see encryptData) holding the length and hash.
+// the part in front of the key slots is bound to the encrypted data, see associatedData.
+// the header of matrix embedded data ends with the number of data bits per group (see matrix.go).
+// everything behind the random salt is masked with a keystream derived from it (see maskHeader), so the header has
+// no fixed magic value and its fields look random. the salt is public, so this only hides the header from anyone
+// scanning images for known signatures or reading the length, not from someone who knows the format.
+// images without a header were written before the container was introduced, see locateLegacy
+const containerMagic = "STUF"
+const containerVersion = 1
+
+const headerSaltSize = 16
+const headerHKDFInfo = "stuffer header mask"
+
+// maximum number of key slots, i.e. recipients of encrypted data
+const maxKeySlots = 16
+const maxHeaderSize = headerSaltSize + len(containerMagic) + 3 + 3 + maxKeySlots*maxRSAKeyBits/8 + sealedTailSize + 1
+
+const (
+	flagHashed byte = 1 << iota
+	flagEncrypted
+	flagCompressed
+	// flagSigned marks encrypted data that starts with a signature block, see signData
+	flagSigned
+	// flagMatrix marks data stored with matrix embedding, see matrix.go
+	flagMatrix
+)
+
+const knownFlags = flagHashed | flagEncrypted | flagCompressed | flagSigned | flagMatrix
+
+// the layout byte describes how the hidden data is spread over the pixels,
+// the lowest 4 bits hold the number of bits used per channel
+const layoutBitsMask byte = 0x0f
+const layoutAlpha byte = 0x10
+
+const knownLayout = layoutBitsMask | layoutAlpha
+
+// KeyType is the kind of key the hidden data is encrypted for
+type KeyType byte
+
+const (
+	KEY_RSA KeyType = iota + 1
+	KEY_X25519
+	KEY_P256
+	// KEY_PASSPHRASE is used for data decrypted with a passphrase, it is never stored in the header
+	KEY_PASSPHRASE
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KEY_RSA:
+		return "RSA"
+	case KEY_X25519:
+		return "X25519"
+	case KEY_P256:
+		return "P-256"
+	case KEY_PASSPHRASE:
+		return "passphrase"
+	}
+	return fmt.Sprintf("unknown key type %d", byte(t))
+}
+
+// ParseKeyType parses the key type names used by the command line, "rsa", "x25519" and "p256"
+func ParseKeyType(name string) (KeyType, error) {
+	switch strings.ToLower(name) {
+	case "rsa":
+		return KEY_RSA, nil
+	case "x25519":
+		return KEY_X25519, nil
+	case "p256", "p-256":
+		return KEY_P256, nil
+	case "passphrase":
+		return KEY_PASSPHRASE, nil
+	}
+	return 0, fmt.Errorf("unsupported key type %s, it must be rsa, x25519, p256 or passphrase", name)
+}
+
+var errNoHeader = errors.New("no container header found")
+
+type ContainerHeader struct {
+	version byte
+	flags   byte
+	layout  Layout
+	length  uint32
+	hash    []byte
+	// keyType is only known once a key slot was decrypted, images in the legacy layout are always encrypted for RSA keys
+	keyType   KeyType
+	blockSize int
+	// number of key slots, each is blockSize bytes. images in the legacy layout have a single key block instead
+	slots    int
+	keyBlock []byte
+	// tail sealed with the data key, images in the legacy layout have the tail inside the key block
+	tail []byte
+	// number of data bits per group of matrix embedded data
+	matrixBits int
+	// salt of the header mask
+	salt []byte
+}
+
+// newContainerHeader returns a header of the current version with a new random salt
+func newContainerHeader(layout Layout) (*ContainerHeader, error) {
+	salt := make([]byte, headerSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate the header salt: %s", err.Error())
+	}
+	return &ContainerHeader{version: containerVersion, layout: layout, salt: salt}, nil
+}
+
+func (h *ContainerHeader) hashed() bool {
+	return h.flags&flagHashed != 0
+}
+
+func (h *ContainerHeader) encrypted() bool {
+	return h.flags&flagEncrypted != 0
+}
+
+func (h *ContainerHeader) compressed() bool {
+	return h.flags&flagCompressed != 0
+}
+
+func (h *ContainerHeader) signed() bool {
+	return h.flags&flagSigned != 0
+}
+
+func (h *ContainerHeader) matrix() bool {
+	return h.flags&flagMatrix != 0
+}
+
+func (h *ContainerHeader) flagNames() string {
+	var names []string
+	if h.hashed() {
+		names = append(names, "hashed")
+	}
+	if h.encrypted() {
+		names = append(names, "encrypted")
+	}
+	if h.compressed() {
+		names = append(names, "compressed")
+	}
+	if h.signed() {
+		names = append(names, "signed")
+	}
+	if h.matrix() {
+		names = append(names, fmt.Sprintf("matrix (%d bits per group)", h.matrixBits))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// prefixLen returns the size of the unencrypted part of the header that precedes the length or key slots
+func (h *ContainerHeader) prefixLen() int {
+	if h.encrypted() {
+		// the slot count and slot size
+		return len(containerMagic) + 3 + 3
+	}
+	return len(containerMagic) + 3
+}
+
+// legacyPadding reports whether the key block uses PKCS#1 v1.5 padding, which is only the case for images in the legacy layout
+func (h *ContainerHeader) legacyPadding() bool {
+	return h.version == 0
+}
+
+// associatedData returns the unencrypted part of the header that precedes the key block. it is used
+// as the OAEP label or key wrap additional data and as the AES GCM additional data, so changing it makes the decryption fail.
+// containers with legacy padding do not authenticate the header
+func (h *ContainerHeader) associatedData() []byte {
+	if h.legacyPadding() {
+		return nil
+	}
+	return h.marshalPrefix()
+}
+
+// Size returns the number of bytes the header occupies in the hidden data
+func (h *ContainerHeader) Size() int {
+	return headerSaltSize + h.fieldsSize()
+}
+
+// fieldsSize returns the size of the header behind the salt
+func (h *ContainerHeader) fieldsSize() int {
+	if h.matrix() {
+		return h.baseSize() + 1
+	}
+	return h.baseSize()
+}
+
+// baseSize returns the size of the header without the matrix embedding field
+func (h *ContainerHeader) baseSize() int {
+	if h.encrypted() {
+		return h.prefixLen() + h.slots*h.blockSize + sealedTailSize
+	}
+	if h.hashed() {
+		return h.prefixLen() + fsizeLen + hashSize
+	}
+	return h.prefixLen() + fsizeLen
+}
+
+// marshalPrefix serializes the header up to the length or key slots
+func (h *ContainerHeader) marshalPrefix() []byte {
+	buf := make([]byte, 0, h.Size())
+	buf = append(buf, containerMagic...)
+	layout := byte(h.layout.Bits) & layoutBitsMask
+	if h.layout.Alpha {
+		layout |= layoutAlpha
+	}
+	buf = append(buf, h.version, h.flags, layout)
+	if h.encrypted() {
+		buf = append(buf, byte(h.slots))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(h.blockSize))
+	}
+	return buf
+}
+
+// marshal serializes the header and masks it behind the salt
+func (h *ContainerHeader) marshal() ([]byte, error) {
+	if len(h.salt) != headerSaltSize {
+		return nil, fmt.Errorf("the header salt has %d bytes instead of %d", len(h.salt), headerSaltSize)
+	}
+	buf := h.marshalFields()
+	if err := maskHeader(h.salt, buf); err != nil {
+		return nil, err
+	}
+	return append(slices.Clone(h.salt), buf...), nil
+}
+
+// marshalFields serializes the header without the salt, for encrypted containers the key slots and sealed tail replace the length and hash
+func (h *ContainerHeader) marshalFields() []byte {
+	buf := h.marshalPrefix()
+	if h.encrypted() {
+		buf = append(buf, h.keyBlock...)
+		buf = append(buf, h.tail...)
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, h.length)
+		if h.hashed() {
+			buf = append(buf, h.hash...)
+		}
+	}
+	if h.matrix() {
+		buf = append(buf, byte(h.matrixBits))
+	}
+	return buf
+}
+
+// maskHeader XORs the header fields with a keystream derived from the salt, which masks and unmasks them
+func maskHeader(salt []byte, data []byte) error {
+	key, err := hkdf.Key(sha256.New, salt, nil, headerHKDFInfo, 32)
+	if err != nil {
+		return fmt.Errorf("failed to derive the header mask: %s", err.Error())
+	}
+	mask := make([]byte, len(data))
+	randv2.NewChaCha8([32]byte(key)).Read(mask)
+	subtle.XORBytes(data, data, mask)
+	return nil
+}
+
+// parseContainerHeader unmasks and parses the header at the beginning of the hidden data. errNoHeader is returned if
+// the unmasked data does not start with the container magic, which is the case for legacy or shuffled images
+func parseContainerHeader(data []byte) (*ContainerHeader, error) {
+	if len(data) < headerSaltSize+len(containerMagic)+3 {
+		return nil, errNoHeader
+	}
+	fields := bytes.Clone(data[headerSaltSize:])
+	if err := maskHeader(data[:headerSaltSize], fields); err != nil {
+		return nil, err
+	}
+	h, err := parseContainerFields(fields)
+	if err != nil {
+		return nil, err
+	}
+	h.salt = data[:headerSaltSize]
+	return h, nil
+}
+
+// parseContainerFields parses the unmasked header behind the salt, starting with the container magic
+func parseContainerFields(data []byte) (*ContainerHeader, error) {
+	if string(data[:len(containerMagic)]) != containerMagic {
+		return nil, errNoHeader
+	}
+	h := &ContainerHeader{
+		version: data[len(containerMagic)],
+		flags:   data[len(containerMagic)+1],
+	}
+	if h.version != containerVersion {
+		return nil, fmt.Errorf("unsupported container version %d", h.version)
+	}
+	if h.flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unknown container flags %08b", h.flags&^knownFlags)
+	}
+	if h.signed() && (!h.encrypted() || !h.hashed()) {
+		return nil, fmt.Errorf("%w: only encrypted and hashed data can be signed", ErrCorrupted)
+	}
+	layout := data[len(containerMagic)+2]
+	if layout&^knownLayout != 0 {
+		return nil, fmt.Errorf("unknown container layout %08b", layout&^knownLayout)
+	}
+	h.layout = Layout{
+		Bits:  int(layout & layoutBitsMask),
+		Alpha: layout&layoutAlpha != 0,
+	}
+	if len(data) < h.prefixLen() {
+		return nil, fmt.Errorf("%w: container header is truncated", ErrCorrupted)
+	}
+	if h.encrypted() {
+		pos := len(containerMagic) + 3
+		h.slots = int(data[pos])
+		h.blockSize = int(binary.BigEndian.Uint16(data[pos+1:]))
+		if err := checkKeySlots(h.slots, h.blockSize); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCorrupted, err.Error())
+		}
+	}
+	if len(data) < h.fieldsSize() {
+		return nil, fmt.Errorf("%w: container header is truncated", ErrCorrupted)
+	}
+	if h.matrix() {
+		h.matrixBits = int(data[h.fieldsSize()-1])
+		if h.matrixBits < 1 || h.matrixBits > matrixMaxBits {
+			return nil, fmt.Errorf("%w: invalid number of matrix embedding bits %d", ErrCorrupted, h.matrixBits)
+		}
+	}
+	pos := h.prefixLen()
+	if h.encrypted() {
+		// length and hash are inside the sealed tail
+		h.keyBlock = data[pos : pos+h.slots*h.blockSize]
+		h.tail = data[pos+h.slots*h.blockSize : h.baseSize()]
+		return h, nil
+	}
+	h.length = binary.BigEndian.Uint32(data[pos : pos+fsizeLen])
+	if h.hashed() {
+		h.hash = data[pos+fsizeLen : pos+fsizeLen+hashSize]
+	}
+	return h, nil
+}
+
+// HiddenData gives access to the hidden bytes of an image, it is implemented by ImageByteReader
+// and by bytes.Reader for data that had to be unshuffled in memory
+type HiddenData interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	Size() int64
+}
+
+// hiddenDataSource returns the hidden data of the image with the layout, in one of the ways it can be spread over the image
+type hiddenDataSource func(ctx context.Context, im image.Image, layout Layout) (HiddenData, error)
+
+// plainSource reads the bits from the image only when needed
+func plainSource(ctx context.Context, im image.Image, layout Layout) (HiddenData, error) {
+	ibr, err := NewImageByteReader(im, layout)
+	if err != nil {
+		return nil, err
+	}
+	ibr.ctx = ctx
+	return ibr, nil
+}
+
+// errLayoutNotUsed is returned by sources that cannot have written data with the layout
+var errLayoutNotUsed = errors.New("the layout is not used by the source")
+
+// shuffleAlgorithm is one of the ways shuffled data may have been shuffled
+type shuffleAlgorithm struct {
+	// positions returns the positions of the first count bytes of the data in shuffled data of n bytes
+	positions func(ctx context.Context, n int, count int) ([]int, error)
+	unshuffle func(ctx context.Context, data []byte) error
+	// layouts the algorithm was used with, all of them if empty
+	layouts []Layout
+}
+
+// shuffledSource reads the first bytes of the shuffled data, which hold the header, straight from their positions in the image.
+// only once more is read, the hidden data is extracted as a whole and unshuffled
+func shuffledSource(shuffle shuffleAlgorithm) hiddenDataSource {
+	return func(ctx context.Context, im image.Image, layout Layout) (HiddenData, error) {
+		if len(shuffle.layouts) > 0 && !slices.Contains(shuffle.layouts, layout) {
+			return nil, errLayoutNotUsed
+		}
+		ibr, err := NewImageByteReader(im, layout)
+		if err != nil {
+			return nil, err
+		}
+		ibr.ctx = ctx
+		positions, err := shuffle.positions(ctx, int(ibr.Size()), maxHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		sd := &shuffledData{ctx: ctx, ibr: ibr, layout: layout, positions: positions, unshuffle: shuffle.unshuffle}
+		return io.NewSectionReader(sd, 0, ibr.Size()), nil
+	}
+}
+
+// shuffledData is the unshuffled view of the hidden data of an image, see shuffledSource
+type shuffledData struct {
+	ctx       context.Context
+	ibr       *ImageByteReader
+	layout    Layout
+	positions []int
+	unshuffle func(ctx context.Context, data []byte) error
+	// all of the unshuffled data, once it was needed
+	data []byte
+}
+
+func (sd *shuffledData) ReadAt(data []byte, off int64) (int, error) {
+	if sd.data == nil && off >= 0 && off+int64(len(data)) <= int64(len(sd.positions)) {
+		for i := range data {
+			if _, err := sd.ibr.ReadAt(data[i:i+1], int64(sd.positions[off+int64(i)])); err != nil {
+				return i, err
+			}
+		}
+		return len(data), nil
+	}
+	if sd.data == nil {
+		hiddenData, err := getHiddenBytes(sd.ctx, sd.ibr.Image(), sd.layout)
+		if err != nil {
+			return 0, err
+		}
+		if err := sd.unshuffle(sd.ctx, hiddenData); err != nil {
+			return 0, err
+		}
+		sd.data = hiddenData
+	}
+	return bytes.NewReader(sd.data).ReadAt(data, off)
+}
+
+// scatteredSource gathers the scattered bits from the image only when needed
+func scatteredSource(key [32]byte) hiddenDataSource {
+	return func(ctx context.Context, im image.Image, layout Layout) (HiddenData, error) {
+		ib, err := newImageBits(im, layout)
+		if err != nil {
+			return nil, err
+		}
+		sb, err := newScatteredBits(ctx, ib, key)
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(sb, 0, sb.Size()), nil
+	}
+}
+
+// findContainer looks for a container header in the hidden data of every layout the image could have been encoded with,
+// until it finds one that was written with that layout. with a shuffle seed the data is gathered as scattered data first, then unshuffled with
+// the keyed shuffle and last with the legacy shuffle. if none is found, errNoHeader is returned together with the hidden data for 1 bit per channel,
+// which is what the legacy layout uses
+func findContainer(ctx context.Context, im image.Image, opts *Options) (HiddenData, *ContainerHeader, error) {
+	sources, err := hiddenDataSources(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var legacySource HiddenData
+	for _, source := range sources {
+		src, header, err := findContainerHeader(ctx, im, source, opts)
+		if !errors.Is(err, errNoHeader) {
+			return src, header, err
+		}
+		// the legacy layout was always shuffled with the legacy shuffle, which is tried last
+		legacySource = src
+	}
+	return legacySource, nil, errNoHeader
+}
+
+// findContainerHeader looks for a container header in the hidden data of every layout, read from the source
+func findContainerHeader(ctx context.Context, im image.Image, source hiddenDataSource, opts *Options) (HiddenData, *ContainerHeader, error) {
+	var legacySource HiddenData
+	for _, layout := range candidateLayouts(im) {
+		opts.logf("looking for container header using %s", layout)
+		src, err := source(ctx, im, layout)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		} else if errors.Is(err, errLayoutNotUsed) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get hidden data from image: %s", err.Error())
+		}
+		if layout == (Layout{Bits: 1}) {
+			legacySource = src
+		}
+		headerData := make([]byte, min(int64(maxHeaderSize), src.Size()))
+		n, err := src.ReadAt(headerData, 0)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		} else if err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("failed to read container header: %s", err.Error())
+		}
+		header, err := parseContainerHeader(headerData[:n])
+		if errors.Is(err, errNoHeader) {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if header.layout != layout {
+			// the magic matched by chance
+			continue
+		}
+		return src, header, nil
+	}
+	if legacySource == nil {
+		_, err := channelCount(im, false)
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, err.Error())
+	}
+	return legacySource, nil, errNoHeader
+}
+
+// remainingSize returns the number of bytes between the current position and the end
+func remainingSize(s io.Seeker) (int64, error) {
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.Seek(cur, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - cur, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	n, err := cw.w.Write(data)
+	cw.n += int64(n)
+	return n, err
+}
+
+func compressData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(data); err != nil {
+		return nil, err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
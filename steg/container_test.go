@@ -0,0 +1,163 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testHeader returns a header with every field the flags need filled in
+func testHeader(t *testing.T, flags byte) *ContainerHeader {
+	t.Helper()
+	h, err := newContainerHeader(Layout{Bits: 2, Alpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.flags = flags
+	if h.encrypted() {
+		h.slots = 2
+		h.blockSize = passphraseBlockSize()
+		h.keyBlock = make([]byte, h.slots*h.blockSize)
+		rand.Read(h.keyBlock)
+		h.tail = make([]byte, sealedTailSize)
+		rand.Read(h.tail)
+	} else {
+		h.length = 1234
+		if h.hashed() {
+			h.hash = make([]byte, hashSize)
+			rand.Read(h.hash)
+		}
+	}
+	if h.matrix() {
+		h.matrixBits = 5
+	}
+	return h
+}
+
+func TestContainerHeaderRoundTrip(t *testing.T) {
+	for flags := byte(0); flags <= knownFlags; flags++ {
+		h := testHeader(t, flags)
+		if h.signed() && (!h.encrypted() || !h.hashed()) {
+			continue
+		}
+		data, err := h.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != h.Size() {
+			t.Errorf("flags %08b: marshalled %d bytes, but the size is %d", flags, len(data), h.Size())
+		}
+		if bytes.Contains(data, []byte(containerMagic)) {
+			t.Errorf("flags %08b: the masked header contains the magic", flags)
+		}
+		// the header is followed by the data
+		parsed, err := parseContainerHeader(append(data, 1, 2, 3))
+		if err != nil {
+			t.Fatalf("flags %08b: %s", flags, err.Error())
+		}
+		if !reflect.DeepEqual(parsed, h) {
+			t.Errorf("flags %08b: parsed %+v, marshalled %+v", flags, parsed, h)
+		}
+	}
+}
+
+func TestParseContainerHeaderErrors(t *testing.T) {
+	noise := make([]byte, maxHeaderSize)
+	rand.Read(noise)
+	if _, err := parseContainerHeader(noise); !errors.Is(err, errNoHeader) {
+		t.Errorf("random data: got %v", err)
+	}
+
+	marshal := func(h *ContainerHeader) []byte {
+		data, err := h.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	h := testHeader(t, flagHashed|flagEncrypted)
+	data := marshal(h)
+	if _, err := parseContainerHeader(data[:len(data)-1]); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("truncated header: got %v", err)
+	}
+	data[0] ^= 1
+	if _, err := parseContainerHeader(data); !errors.Is(err, errNoHeader) {
+		t.Errorf("changed salt: got %v", err)
+	}
+	if _, err := parseContainerHeader(append(h.marshalFields(), make([]byte, headerSaltSize)...)); !errors.Is(err, errNoHeader) {
+		t.Errorf("unmasked header: got %v", err)
+	}
+	h.slots = maxKeySlots + 1
+	if _, err := parseContainerHeader(marshal(h)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("too many key slots: got %v", err)
+	}
+
+	for _, version := range []byte{0, containerVersion + 1} {
+		h = testHeader(t, flagHashed)
+		h.version = version
+		if _, err := parseContainerHeader(marshal(h)); err == nil || errors.Is(err, errNoHeader) {
+			t.Errorf("version %d header: got %v", version, err)
+		}
+	}
+	h = testHeader(t, flagHashed)
+	h.flags |= 0x80
+	if _, err := parseContainerHeader(marshal(h)); err == nil || errors.Is(err, errNoHeader) {
+		t.Errorf("unknown flag: got %v", err)
+	}
+}
+
+// the fixtures in testdata were written by the first version of stuffer, which had no container header
+func TestDecodeFixtures(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "payload.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadPrivateKeyWithPassphrase(filepath.Join("testdata", "legacy_rsa.pem"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		image   string
+		opts    Options
+		version int
+	}{
+		{"legacy.png", Options{}, 0},
+		{"legacy_nh.png", Options{NoHash: true}, 0},
+		{"legacy_ss.png", Options{ShuffleSeed: "seed"}, 0},
+		{"legacy_rsa.png", Options{PrivateKey: key, LegacyRSA: true}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.image, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", test.image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			img, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, meta, err := Decode(context.Background(), img, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Errorf("decoded %q", data)
+			}
+			if meta.Version != test.version {
+				t.Errorf("version %d, expected %d", meta.Version, test.version)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package steg
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"image"
+	"io"
+)
+
+// container is the hidden data found in an image, with the length and hash filled in from the
+// decrypted tail for encrypted data
+type container struct {
+	src    HiddenData
+	header *ContainerHeader
+	// offset of the stored data in the hidden data
+	offset int64
+	// info is only set for encrypted data once the tail was decrypted
+	info *EncryptedImageInformation
+}
+
+func (c *container) metadata() Metadata {
+	meta := c.header.metadata()
+	if c.info != nil {
+		meta.Extension = c.info.extension
+		meta.Timestamp = c.info.timestamp
+		meta.Nonce = c.info.nonce
+		meta.KeyType = c.info.keyType
+		meta.KeyBits = c.info.keyBits
+		meta.Signature = c.info.signature
+		meta.SignatureVerified = c.info.signatureVerified
+	}
+	return meta
+}
+
+// stored returns the stored data behind the header, the length is not taken into account
+func (c *container) stored() *io.SectionReader {
+	cover := io.NewSectionReader(c.src, c.offset, c.src.Size()-c.offset)
+	if !c.header.matrix() {
+		return cover
+	}
+	md := &matrixData{cover: cover, coverSize: cover.Size(), k: c.header.matrixBits}
+	return io.NewSectionReader(md, 0, md.Size())
+}
+
+// locateContainer finds the hidden data and decrypts the tail if the data is encrypted and a private key was given
+func locateContainer(ctx context.Context, img image.Image, opts *Options) (*container, error) {
+	src, header, err := findContainer(ctx, img, opts)
+	if errors.Is(err, errNoHeader) {
+		opts.logf("no container header found, using the legacy layout")
+		c, err := locateLegacy(src, opts)
+		if (errors.Is(err, ErrNoData) || errors.Is(err, ErrCorrupted)) && opts.ShuffleSeed == "" {
+			return c, fmt.Errorf("%w (no container header was found, if the image was shuffled the seed is required)", err)
+		}
+		return c, err
+	} else if err != nil {
+		return nil, err
+	}
+	opts.logf("found container header version %d, flags: %s, layout: %s", header.version, header.flagNames(), header.layout)
+	c := &container{src: src, header: header, offset: int64(header.Size())}
+	available := c.stored().Size()
+	if header.encrypted() {
+		if opts.PrivateKey == nil && len(opts.Passphrase) == 0 {
+			return c, nil
+		}
+		if err = c.decryptTail(header.keyBlock, opts); err != nil {
+			return c, err
+		}
+	}
+	if int64(header.length) > available {
+		return c, fmt.Errorf("%w: length is too large: %d > %d", ErrCorrupted, header.length, available)
+	}
+	return c, nil
+}
+
+func (c *container) decryptTail(tailBlock []byte, opts *Options) error {
+	if c.header.legacyPadding() && !opts.LegacyRSA {
+		return ErrLegacyRSA
+	}
+	var info *EncryptedImageInformation
+	var err error
+	if c.header.slots > 0 {
+		info, err = decryptKeySlots(opts, c.header.slots, tailBlock, c.header.tail, c.header.associatedData())
+	} else {
+		// images in the legacy layout have a single RSA block holding the whole tail
+		info, err = decryptTail(opts.PrivateKey, opts, c.header.keyType, tailBlock, nil, c.header.associatedData())
+	}
+	if err != nil {
+		return err
+	}
+	c.info = info
+	c.header.length = info.length
+	if c.header.hashed() {
+		c.header.hash = info.hash
+	}
+	return nil
+}
+
+// locateLegacy reads the tail of images written before the container header was introduced,
+// these store the length and hash (or the RSA block) at the end of the hidden data
+// and require the same options that were used when encoding
+func locateLegacy(src HiddenData, opts *Options) (*container, error) {
+	capacity := src.Size()
+	c := &container{src: src, header: &ContainerHeader{layout: Layout{Bits: 1}}}
+	if !opts.NoHash {
+		c.header.flags |= flagHashed
+	}
+
+	// handle encryption case
+	if opts.PrivateKey != nil {
+		c.header.flags |= flagEncrypted
+		c.header.keyType = KEY_RSA
+		rsaPriv, ok := opts.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return c, fmt.Errorf("%w: images in the legacy layout can only be encrypted for RSA keys", ErrWrongKey)
+		}
+		// the RSA tail is as large as the key's modulus
+		keySize := int64(rsaPriv.Size())
+		c.header.blockSize = int(keySize)
+		if capacity < keySize {
+			return c, fmt.Errorf("%w: image is too small to hold the RSA tail", ErrNoData)
+		}
+		tailBlock := make([]byte, keySize)
+		if _, err := src.ReadAt(tailBlock, capacity-keySize); err != nil {
+			return c, fmt.Errorf("failed to read the RSA tail: %w", err)
+		}
+		if err := c.decryptTail(tailBlock, opts); err != nil {
+			return c, err
+		}
+		if int64(c.header.length) > capacity-keySize {
+			return c, fmt.Errorf("%w: length of data %d is higher than available max length %d", ErrCorrupted, c.header.length, capacity-keySize)
+		}
+		return c, nil
+	}
+
+	// length and hash
+	if capacity < hashSize+fsizeLen {
+		return c, fmt.Errorf("%w: image is too small to hold the tail", ErrNoData)
+	}
+	tail := make([]byte, hashSize+fsizeLen)
+	if _, err := src.ReadAt(tail, capacity-hashSize-fsizeLen); err != nil {
+		return c, fmt.Errorf("failed to read the tail: %w", err)
+	}
+	lenStart := capacity - hashSize - fsizeLen
+	dataLength := binary.BigEndian.Uint32(tail[:fsizeLen])
+	if dataLength == 0 {
+		return c, fmt.Errorf("%w: data length is zero", ErrNoData)
+	}
+	if int64(dataLength) > lenStart {
+		return c, fmt.Errorf("%w: length is too large: %d > %d", ErrNoData, dataLength, lenStart)
+	}
+	c.header.length = dataLength
+	if c.header.hashed() {
+		c.header.hash = tail[fsizeLen:]
+	}
+	return c, nil
+}
+
+// Inspect returns the metadata of the hidden data without extracting it. for encrypted data the length, hash,
+// extension and timestamp are only known if the private key is given, otherwise they are left empty
+func Inspect(ctx context.Context, img image.Image, opts Options) (Metadata, error) {
+	c, err := locateContainer(ctx, img, &opts)
+	if c == nil {
+		return Metadata{}, err
+	}
+	return c.metadata(), err
+}
+
+// Decode finds the hidden data in the image and returns a reader for it together with its metadata.
+// the data is read from the image lazily, so the image must not be modified until the reader is drained.
+// if the data was hashed, the reader returns ErrHashMismatch instead of io.EOF when the data does not match.
+// the context also applies to reading from the returned reader
+func Decode(ctx context.Context, img image.Image, opts Options) (io.Reader, Metadata, error) {
+	c, err := locateContainer(ctx, img, &opts)
+	if c == nil {
+		return nil, Metadata{}, err
+	} else if err != nil {
+		return nil, c.metadata(), err
+	}
+	if opts.VerifyKey != nil && !c.header.signed() {
+		return nil, c.metadata(), fmt.Errorf("%w: the data is not signed", ErrSignature)
+	}
+	if !c.header.encrypted() {
+		stored := io.NewSectionReader(c.stored(), 0, int64(c.header.length))
+		return payloadReader(ctx, c.header, stored, &opts), c.metadata(), nil
+	}
+	if c.info == nil {
+		return nil, c.metadata(), ErrKeyRequired
+	}
+	dataBlock := make([]byte, c.header.length)
+	if n, err := c.stored().ReadAt(dataBlock, 0); err != nil {
+		return nil, c.metadata(), fmt.Errorf("failed to read encrypted data (%d out of %d bytes read): %w", n, len(dataBlock), err)
+	}
+	plainData, err := c.info.decryptData(&opts, dataBlock)
+	if err != nil {
+		return nil, c.metadata(), err
+	}
+	if c.header.signed() {
+		if plainData, err = c.info.checkSignature(&opts, plainData); err != nil {
+			return nil, c.metadata(), err
+		}
+	}
+	return payloadReader(ctx, c.header, bytes.NewReader(plainData), &opts), c.metadata(), nil
+}
+
+// hashingReader hashes the data while it is read and checks the hash at the end
+type hashingReader struct {
+	ctx    context.Context
+	r      io.Reader
+	hasher hash.Hash
+	hash   []byte
+}
+
+func (hr *hashingReader) Read(data []byte) (int, error) {
+	if err := hr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := hr.r.Read(data)
+	hr.hasher.Write(data[:n])
+	if err == io.EOF && hr.hash != nil && !bytes.Equal(hr.hasher.Sum(nil), hr.hash) {
+		return n, ErrHashMismatch
+	}
+	return n, err
+}
+
+// payloadReader decompresses the stored data if needed and checks the hash along the way
+func payloadReader(ctx context.Context, header *ContainerHeader, stored io.Reader, opts *Options) io.Reader {
+	if header.compressed() {
+		opts.logf("decompressing data")
+		stored = flate.NewReader(stored)
+	}
+	hr := &hashingReader{ctx: ctx, r: stored, hasher: sha256.New()}
+	if header.hashed() {
+		hr.hash = header.hash
+	}
+	return hr
+}
@@ -0,0 +1,121 @@
+package steg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// ECDH keys do not encrypt the data key themselves. instead a new ephemeral key pair is generated for every image,
+// the shared secret with the recipient's key is stretched with HKDF into an AES key which seals the data key.
+// the key block looks like this: [ephemeral public key, sealed data key]
+const ecdhHKDFInfo = "stuffer ecdh key wrap"
+
+func ecdhKeyType(curve ecdh.Curve) (KeyType, error) {
+	switch curve {
+	case ecdh.X25519():
+		return KEY_X25519, nil
+	case ecdh.P256():
+		return KEY_P256, nil
+	}
+	return 0, fmt.Errorf("unsupported elliptic curve %s, only X25519 and P-256 are supported", curve)
+}
+
+func (t KeyType) curve() ecdh.Curve {
+	switch t {
+	case KEY_X25519:
+		return ecdh.X25519()
+	case KEY_P256:
+		return ecdh.P256()
+	}
+	return nil
+}
+
+// ecdhPublicKeySize returns the size of the encoded public key, P-256 keys are stored uncompressed
+func ecdhPublicKeySize(curve ecdh.Curve) int {
+	if curve == ecdh.P256() {
+		return 65
+	}
+	return 32
+}
+
+// ecdhBlockSize returns the size of the key block for the curve
+func ecdhBlockSize(curve ecdh.Curve) int {
+	return ecdhPublicKeySize(curve) + dataKeySize + gcmTagSize
+}
+
+// ecdhKeyCipher derives the AES GCM cipher sealing the data key from the shared secret, both public keys
+// are used as salt so the key is bound to this exchange
+func ecdhKeyCipher(secret []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key, err := hkdf.Key(sha256.New, secret, salt, ecdhHKDFInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the key wrapping key: %s", err.Error())
+	}
+	cip, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	return gcm, nil
+}
+
+func wrapKeyWithECDH(pub *ecdh.PublicKey, aesKey []byte, aad []byte) ([]byte, error) {
+	ephemeral, err := pub.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %s", err.Error())
+	}
+	secret, err := ephemeral.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform ECDH: %s", err.Error())
+	}
+	encoded := ephemeral.PublicKey().Bytes()
+	if pub.Curve() == ecdh.X25519() {
+		// X25519 ignores the highest bit of public keys, which is always clear in generated keys.
+		// setting it at random keeps it from telling used slots from the random unused ones
+		var b [1]byte
+		if _, err = rand.Read(b[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate random bit: %s", err.Error())
+		}
+		encoded[len(encoded)-1] |= b[0] & 0x80
+	}
+	gcm, err := ecdhKeyCipher(secret, encoded, pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// the key is only used once, so a zero nonce is fine
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Seal(encoded, nonce, aesKey, aad), nil
+}
+
+func unwrapKeyWithECDH(priv *ecdh.PrivateKey, keyBlock []byte, aad []byte) ([]byte, error) {
+	keySize := ecdhPublicKeySize(priv.Curve())
+	if len(keyBlock) < keySize {
+		return nil, fmt.Errorf("%w: key block is too short: %d bytes", ErrCorrupted, len(keyBlock))
+	}
+	ephemeral, err := priv.Curve().NewPublicKey(keyBlock[:keySize])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ephemeral key: %s", ErrCorrupted, err.Error())
+	}
+	secret, err := priv.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to perform ECDH: %s", ErrCorrupted, err.Error())
+	}
+	gcm, err := ecdhKeyCipher(secret, keyBlock[:keySize], priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	aesKey, err := gcm.Open(nil, nonce, keyBlock[keySize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt the key block: %s", ErrWrongKey, err.Error())
+	}
+	return aesKey, nil
+}
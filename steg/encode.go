@@ -0,0 +1,357 @@
+package steg
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Encode embeds the payload into the image. the image is modified in place if the data can be embedded
+// into it directly, otherwise (e.g. for YCbCr images decoded from JPEG) a NRGBA copy is used instead.
+// the returned image holds the data either way and should be saved in a lossless format like PNG.
+// if the data does not fit, ErrCapacity is returned before the image is changed
+func Encode(ctx context.Context, img image.Image, payload io.Reader, opts Options) (image.Image, error) {
+	wi, converted := EnsureWritableImage(img, opts.layout())
+	if converted {
+		opts.logf("converted input image from %T to %T, the output will be a lossless PNG", img, wi)
+	}
+	if err := encodeImage(ctx, wi, payload, &opts); err != nil {
+		return nil, err
+	}
+	return wi, nil
+}
+
+// dataSize returns the remaining size of the data, if it can be determined without reading it
+func dataSize(data io.Reader) (int64, bool) {
+	s, ok := data.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	size, err := remainingSize(s)
+	return size, err == nil
+}
+
+func encodeImage(ctx context.Context, wi WritableImage, data io.Reader, opts *Options) error {
+	ibw, err := NewImageByteWriter(wi, opts.layout())
+	if err != nil {
+		return fmt.Errorf("%w: failed to create image byte writer: %s", ErrUnsupportedImage, err.Error())
+	}
+	ibw.ctx = ctx
+	// moving the rank of a paletted image out of its pair could change the transparency of the pixel,
+	// swapping the color with its partner already changes the rank by one
+	_, paletted := wi.(*image.Paletted)
+	ibw.bits.matching = opts.Matching && !paletted
+	if opts.Scatter && opts.ShuffleSeed == "" {
+		return errors.New("scattering the data requires a shuffle seed")
+	}
+	if opts.Scatter && opts.Fill != FILL_NONE {
+		return errors.New("scattered data cannot be combined with filling, scattering only changes the bits holding the data")
+	}
+	header, err := newContainerHeader(opts.layout())
+	if err != nil {
+		return err
+	}
+	if !opts.NoHash {
+		header.flags |= flagHashed
+	}
+	if opts.Compress {
+		header.flags |= flagCompressed
+	}
+	if opts.Matrix {
+		header.flags |= flagMatrix
+	}
+	recipients, slots, slotSize, err := recipientKeys(opts)
+	if err != nil {
+		return err
+	}
+	if slots > 0 {
+		header.flags |= flagEncrypted
+		header.slots = slots
+		header.blockSize = slotSize
+	}
+	if opts.SigningKey != nil {
+		if !header.encrypted() || !header.hashed() {
+			return errors.New("only encrypted and hashed data can be signed, the signature covers the hash, timestamp and extension of encrypted data")
+		}
+		if _, err = signatureAlgorithm(opts.SigningKey); err != nil {
+			return err
+		}
+		header.flags |= flagSigned
+	}
+
+	// the size of uncompressed data is known up front, so fail early if it does not fit
+	if sz, ok := dataSize(data); ok && !opts.Compress {
+		required := int64(header.Size()) + sz
+		if header.encrypted() {
+			// take into account additional data if encrypted
+			overhead, err := calculateGCMOverhead()
+			if err != nil {
+				return fmt.Errorf("failed to get AES128 gcm overhead: %s", err.Error())
+			}
+			required += int64(overhead)
+		}
+		if int64(ibw.Capacity()) < required {
+			return fmt.Errorf("%w. require %dB, but only have %dB", ErrCapacity, required, ibw.Capacity())
+		}
+	}
+
+	if !header.encrypted() && opts.ShuffleSeed == "" && !header.matrix() {
+		return encodeStream(ctx, ibw, header, data, opts)
+	}
+
+	// encryption, shuffling and matrix embedding need all of the data in memory
+	stored, err := prepareData(ctx, header, data, recipients, opts)
+	if err != nil {
+		return err
+	}
+	required := header.Size() + len(stored)
+	if header.matrix() {
+		if header.matrixBits, err = matrixBits(len(stored), ibw.Capacity()-header.Size()); err != nil {
+			return err
+		}
+		required = header.Size() + matrixCoverSize(len(stored), header.matrixBits)
+		opts.logf("matrix embedding %d data bits per %d hidden bits", header.matrixBits, matrixGroupSize(header.matrixBits))
+	}
+	if ibw.Capacity() < required {
+		return fmt.Errorf("%w. require %dB, but only have %dB", ErrCapacity, required, ibw.Capacity())
+	}
+	headerData, err := header.marshal()
+	if err != nil {
+		return err
+	}
+
+	if opts.ShuffleSeed == "" {
+		if header.matrix() {
+			ibr, err := NewImageByteReader(wi, opts.layout())
+			if err != nil {
+				return err
+			}
+			ibr.ctx = ctx
+			if stored, err = embedMatrix(ibr, header, stored); err != nil {
+				return err
+			}
+		}
+		if _, err = ibw.Write(headerData); err != nil {
+			return fmt.Errorf("failed to write the header to the image: %w", err)
+		}
+		if n, err := ibw.Write(stored); err != nil {
+			return fmt.Errorf("failed to write hidden data to the image (%d out of %d bytes written): %w", n, len(stored), err)
+		}
+		return fillImage(ctx, ibw, required, opts)
+	}
+
+	key, err := shuffleKey(opts.ShuffleSeed)
+	if err != nil {
+		return err
+	}
+	if opts.Scatter {
+		// scattering only changes the bits holding the data
+		sb, err := newScatteredBits(ctx, ibw.bits, key)
+		if err != nil {
+			return err
+		}
+		if header.matrix() {
+			if stored, err = embedMatrix(sb, header, stored); err != nil {
+				return err
+			}
+		}
+		opts.logf("scattering data")
+		if n, err := sb.WriteAt(append(headerData, stored...), 0); err != nil {
+			return fmt.Errorf("failed to write hidden data to the image (%d out of %d bytes written): %w", n, len(headerData)+len(stored), err)
+		}
+		return nil
+	}
+
+	// shuffling moves the bits of the whole image around
+	hiddenData, err := getHiddenBytes(ctx, wi, opts.layout())
+	if err != nil {
+		return fmt.Errorf("failed to extract initial image data: %w", err)
+	}
+	if header.matrix() {
+		// embed against the bits at the positions the data is shuffled to, shuffling them back then only changes
+		// the bits changed by matrix embedding
+		if err = unshuffleData(ctx, hiddenData, key); err != nil {
+			return err
+		}
+		if stored, err = embedMatrix(bytes.NewReader(hiddenData), header, stored); err != nil {
+			return err
+		}
+	}
+	copy(hiddenData, headerData)
+	copy(hiddenData[len(headerData):], stored)
+	if opts.Fill != FILL_NONE {
+		// the noise is shuffled along with the data
+		filler, err := newNoiseFiller(opts.Fill)
+		if err != nil {
+			return err
+		}
+		opts.logf("filling %dB of unused capacity with %s noise", len(hiddenData)-required, opts.Fill)
+		filler.fill(hiddenData[required:])
+	}
+	opts.logf("shuffling data")
+	if err = shuffleData(ctx, hiddenData, key); err != nil {
+		return err
+	}
+
+	// write all of the data to the image
+	if n, err := ibw.Write(hiddenData); err != nil {
+		return fmt.Errorf("failed to write hidden data to the image (%d out of %d bytes written): %w", n, len(hiddenData), err)
+	}
+	return nil
+}
+
+// embedMatrix reads the hidden bytes behind the header that are needed to hold the stored data with matrix embedding
+// and returns them with the data embedded
+func embedMatrix(cover io.ReaderAt, header *ContainerHeader, stored []byte) ([]byte, error) {
+	hidden := make([]byte, matrixCoverSize(len(stored), header.matrixBits))
+	if len(hidden) == 0 {
+		return hidden, nil
+	}
+	if _, err := cover.ReadAt(hidden, int64(header.Size())); err != nil {
+		return nil, fmt.Errorf("failed to read the hidden data for matrix embedding: %w", err)
+	}
+	matrixEmbed(hidden, stored, header.matrixBits)
+	return hidden, nil
+}
+
+// cappedBuffer collects the stored data in memory and fails with ErrCapacity once it exceeds the limit
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *cappedBuffer) Write(data []byte) (int, error) {
+	if b.Len()+len(data) > b.limit {
+		return 0, ErrCapacity
+	}
+	return b.Buffer.Write(data)
+}
+
+// encodeStream writes the data into the image behind the header, only touching the bits it needs. data of
+// unknown size and compressed data may not fit, so it is collected in memory first and the image is only changed
+// once it is known to fit. the header is written last, once the length and hash are known
+func encodeStream(ctx context.Context, ibw *ImageByteWriter, header *ContainerHeader, data io.Reader, opts *Options) error {
+	if _, err := ibw.Seek(int64(header.Size()), io.SeekStart); err != nil {
+		return fmt.Errorf("%w to hold the header", ErrCapacity)
+	}
+	cw := &countingWriter{w: ibw}
+	var buf *cappedBuffer
+	if _, known := dataSize(data); opts.Compress || !known {
+		buf = &cappedBuffer{limit: ibw.Capacity() - header.Size()}
+		cw.w = buf
+	}
+	var w io.Writer = cw
+	var fw *flate.Writer
+	if opts.Compress {
+		opts.logf("compressing data")
+		var err error
+		if fw, err = flate.NewWriter(cw, flate.BestCompression); err != nil {
+			return fmt.Errorf("failed to compress data: %s", err.Error())
+		}
+		w = fw
+	}
+	hasher := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(data, hasher))
+	if err == nil && fw != nil {
+		err = fw.Close()
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, ErrCapacity) {
+		return fmt.Errorf("%w. only have %dB", ErrCapacity, ibw.Capacity())
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return fmt.Errorf("failed to write hidden data to the image (%d bytes read): %s", n, err.Error())
+	}
+	if opts.Compress {
+		opts.logf("compressed %dB to %dB", n, cw.n)
+	}
+	if cw.n > int64(^uint32(0)) {
+		return fmt.Errorf("invalid data size: %d", cw.n)
+	}
+	header.length = uint32(cw.n)
+	if header.hashed() {
+		header.hash = hasher.Sum(nil)
+	}
+	if buf != nil {
+		if _, err = ibw.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("failed to write hidden data to the image: %w", err)
+		}
+	}
+	if _, err = ibw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	headerData, err := header.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err = ibw.Write(headerData); err != nil {
+		return fmt.Errorf("failed to write the header to the image: %w", err)
+	}
+	return fillImage(ctx, ibw, header.Size()+int(cw.n), opts)
+}
+
+// fillImage fills the capacity behind the first used hidden bytes with the noise of the fill mode
+func fillImage(ctx context.Context, ibw *ImageByteWriter, used int, opts *Options) error {
+	if opts.Fill == FILL_NONE {
+		return nil
+	}
+	opts.logf("filling %dB of unused capacity with %s noise", ibw.Capacity()-used, opts.Fill)
+	if err := fillUnused(ctx, ibw, used, opts.Fill); err != nil {
+		return fmt.Errorf("failed to fill the unused capacity: %w", err)
+	}
+	return nil
+}
+
+// prepareData reads, hashes, compresses and encrypts all of the data for the recipients, filling in the header
+func prepareData(ctx context.Context, header *ContainerHeader, data io.Reader, recipients []crypto.PublicKey, opts *Options) ([]byte, error) {
+	payload, err := io.ReadAll(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read desired data into a byte buffer (%d bytes read): %s", len(payload), err.Error())
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > int64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid data size: %d", len(payload))
+	}
+	var checksum [hashSize]byte
+	if header.hashed() {
+		checksum = sha256.Sum256(payload)
+		header.hash = checksum[:]
+	}
+
+	// compression
+	stored := payload
+	if header.compressed() {
+		opts.logf("compressing data")
+		if stored, err = compressData(payload); err != nil {
+			return nil, fmt.Errorf("failed to compress data: %s", err.Error())
+		}
+		opts.logf("compressed %dB to %dB", len(payload), len(stored))
+	}
+
+	// encryption
+	if header.encrypted() {
+		opts.logf("encrypting data")
+		hashAndLength := make([]byte, fsizeLen+hashSize)
+		copy(hashAndLength[fsizeLen:], checksum[:])
+		var keyBlocks [][]byte
+		if stored, keyBlocks, header.tail, err = encryptData(recipients, opts, stored, opts.Extension, hashAndLength, header.associatedData()); err != nil {
+			return nil, err
+		}
+		if header.keyBlock, err = fillKeySlots(keyBlocks, header.slots, header.blockSize); err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(stored)) > int64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid data size: %d", len(stored))
+	}
+	header.length = uint32(len(stored))
+	return stored, nil
+}
@@ -0,0 +1,40 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestEncodeCapacity(t *testing.T) {
+	original := testImage("nrgba", 100, 80, 5).(*image.NRGBA)
+	ibw, err := NewImageByteWriter(original, Layout{Bits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// random data does not compress, so it does not fit next to the header even when compressed
+	payload := testPayload(ibw.Capacity(), 5)
+	tests := []struct {
+		name string
+		opts Options
+		data func() io.Reader
+	}{
+		{"known size", Options{}, func() io.Reader { return bytes.NewReader(payload) }},
+		{"unknown size", Options{}, func() io.Reader { return iotest.OneByteReader(bytes.NewReader(payload)) }},
+		{"compressed", Options{Compress: true}, func() io.Reader { return bytes.NewReader(payload) }},
+		{"compressed with fill", Options{Compress: true, Fill: FILL_RANDOM}, func() io.Reader { return bytes.NewReader(payload) }},
+	}
+	for _, test := range tests {
+		im := cloneImage(original)
+		if _, err := Encode(context.Background(), im, test.data(), test.opts); !errors.Is(err, ErrCapacity) {
+			t.Errorf("%s: got %v instead of ErrCapacity", test.name, err)
+		}
+		if !bytes.Equal(im.Pix, original.Pix) {
+			t.Errorf("%s: the image was changed although the data does not fit", test.name)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"image"
+	"io"
+	randv2 "math/rand/v2"
+	"testing"
+)
+
+// testKeys generates a key pair of every encryption key type
+func testKeys(t *testing.T) map[KeyType][2]any {
+	t.Helper()
+	keys := make(map[KeyType][2]any)
+	for _, keyType := range []KeyType{KEY_RSA, KEY_X25519, KEY_P256} {
+		priv, pub, err := GenerateKey(keyType, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[keyType] = [2]any{priv, pub}
+	}
+	return keys
+}
+
+// testPayload returns n bytes of random data
+func testPayload(n int, seed byte) []byte {
+	payload := make([]byte, n)
+	randv2.NewChaCha8([32]byte{seed}).Read(payload)
+	return payload
+}
+
+// decodeAll decodes the image and reads all of the data
+func decodeAll(im image.Image, opts Options) ([]byte, Metadata, error) {
+	r, meta, err := Decode(context.Background(), im, opts)
+	if err != nil {
+		return nil, meta, err
+	}
+	data, err := io.ReadAll(r)
+	return data, meta, err
+}
+
+// rewriteHeader parses the container header of an unshuffled image, lets fn change it and writes it back
+func rewriteHeader(t *testing.T, im WritableImage, layout Layout, fn func(h *ContainerHeader)) {
+	t.Helper()
+	hidden, err := getHiddenBytes(context.Background(), im, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseContainerHeader(hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(h)
+	data, err := h.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ibw, err := NewImageByteWriter(im, layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ibw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeRecipients(t *testing.T) {
+	keys := testKeys(t)
+	payload := testPayload(2000, 1)
+	tests := []struct {
+		name       string
+		recipients []KeyType
+		passphrase string
+		slots      int
+	}{
+		{"single", []KeyType{KEY_X25519}, "", 1},
+		{"padded", []KeyType{KEY_X25519, KEY_P256, KEY_RSA}, "", 4},
+		{"passphrase", []KeyType{KEY_P256}, "passphrase", 2},
+	}
+	for _, test := range tests {
+		opts := Options{Passphrase: []byte(test.passphrase)}
+		for _, keyType := range test.recipients {
+			opts.Recipients = append(opts.Recipients, keys[keyType][1].(crypto.PublicKey))
+		}
+		out, err := Encode(context.Background(), testImage("nrgba", 200, 150, 2), bytes.NewReader(payload), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, keyType := range test.recipients {
+			data, meta, err := decodeAll(out, Options{PrivateKey: keys[keyType][0].(crypto.PrivateKey)})
+			if err != nil {
+				t.Fatalf("%s: %s key: %s", test.name, keyType, err)
+			}
+			if !bytes.Equal(data, payload) {
+				t.Errorf("%s: %s key: decoded data differs from the payload", test.name, keyType)
+			}
+			if meta.KeyType != keyType || meta.KeySlots != test.slots {
+				t.Errorf("%s: %s key: decoded with a %s key from %d slots, expected %d slots", test.name, keyType, meta.KeyType, meta.KeySlots, test.slots)
+			}
+		}
+		if test.passphrase != "" {
+			data, meta, err := decodeAll(out, Options{Passphrase: []byte(test.passphrase)})
+			if err != nil {
+				t.Fatalf("%s: passphrase: %s", test.name, err)
+			}
+			if !bytes.Equal(data, payload) || meta.KeyType != KEY_PASSPHRASE {
+				t.Errorf("%s: passphrase: decoded %dB with a %s key", test.name, len(data), meta.KeyType)
+			}
+		}
+
+		// a key of the same type that is not a recipient finds no slot it can decrypt
+		other, _, err := GenerateKey(test.recipients[0], 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = decodeAll(out, Options{PrivateKey: other}); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("%s: decoding with another %s key returned %v instead of ErrWrongKey", test.name, test.recipients[0], err)
+		}
+	}
+}
+
+func TestEncryptedHeaderTampering(t *testing.T) {
+	keys := testKeys(t)
+	payload := testPayload(2000, 2)
+	layout := Layout{Bits: 1}
+	tampers := map[string]func(h *ContainerHeader){
+		"compressed flag": func(h *ContainerHeader) { h.flags ^= flagCompressed },
+		"signed flag":     func(h *ContainerHeader) { h.flags ^= flagSigned },
+		"slot count": func(h *ContainerHeader) {
+			h.slots /= 2
+			h.keyBlock = h.keyBlock[:h.slots*h.blockSize]
+		},
+	}
+	for _, keyType := range []KeyType{KEY_RSA, KEY_X25519} {
+		opts := Options{PublicKey: keys[keyType][1].(crypto.PublicKey), Recipients: []crypto.PublicKey{keys[KEY_P256][1].(crypto.PublicKey)}}
+		out, err := Encode(context.Background(), testImage("nrgba", 200, 150, 3), bytes.NewReader(payload), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, tamper := range tampers {
+			tampered := cloneImage(out.(*image.NRGBA))
+			rewriteHeader(t, tampered, layout, tamper)
+			// the header is bound to the key slots, so none of them can be decrypted anymore
+			if _, _, err := decodeAll(tampered, Options{PrivateKey: keys[keyType][0].(crypto.PrivateKey)}); !errors.Is(err, ErrWrongKey) {
+				t.Errorf("%s key: changing the %s of the header returned %v instead of ErrWrongKey", keyType, name, err)
+			}
+		}
+	}
+}
+
+// cloneImage returns a copy of the image, so it can be changed without changing the original
+func cloneImage(im *image.NRGBA) *image.NRGBA {
+	return &image.NRGBA{Pix: bytes.Clone(im.Pix), Stride: im.Stride, Rect: im.Rect}
+}
+
+func TestEncodeSignature(t *testing.T) {
+	keys := testKeys(t)
+	payload := testPayload(2000, 3)
+	edKey, edPub, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := keys[KEY_RSA][0].(*rsa.PrivateKey)
+	otherKey, otherPub, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		algorithm string
+		key       crypto.PrivateKey
+		pub       crypto.PublicKey
+	}{
+		{"Ed25519", edKey, edPub},
+		{"RSA-PSS", rsaKey, &rsaKey.PublicKey},
+	}
+	layout := Layout{Bits: 1}
+	for _, test := range tests {
+		opts := Options{PublicKey: keys[KEY_X25519][1].(crypto.PublicKey), SigningKey: test.key}
+		out, err := Encode(context.Background(), testImage("nrgba", 200, 150, 4), bytes.NewReader(payload), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decodeOpts := Options{PrivateKey: keys[KEY_X25519][0].(crypto.PrivateKey), VerifyKey: test.pub}
+		data, meta, err := decodeAll(out, decodeOpts)
+		if err != nil {
+			t.Fatalf("%s: %s", test.algorithm, err)
+		}
+		if !bytes.Equal(data, payload) {
+			t.Errorf("%s: decoded data differs from the payload", test.algorithm)
+		}
+		if !meta.Signed || !meta.SignatureVerified || meta.Signature != test.algorithm {
+			t.Errorf("%s: signed %t, verified %t, algorithm %s", test.algorithm, meta.Signed, meta.SignatureVerified, meta.Signature)
+		}
+
+		// the signature of another sender is rejected
+		wrongOpts := decodeOpts
+		wrongOpts.VerifyKey = otherPub
+		if _, _, err = decodeAll(out, wrongOpts); !errors.Is(err, ErrSignature) {
+			t.Errorf("%s: verifying with another key returned %v instead of ErrSignature", test.algorithm, err)
+		}
+		// data signed by another sender is rejected as well
+		wrongOpts.VerifyKey = test.pub
+		opts.SigningKey = otherKey
+		forged, err := Encode(context.Background(), testImage("nrgba", 200, 150, 4), bytes.NewReader(payload), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = decodeAll(forged, wrongOpts); !errors.Is(err, ErrSignature) {
+			t.Errorf("%s: data signed by another key returned %v instead of ErrSignature", test.algorithm, err)
+		}
+
+		// a flipped bit of the payload is rejected
+		flipped := cloneImage(out.(*image.NRGBA))
+		hidden, err := getHiddenBytes(context.Background(), flipped, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := parseContainerHeader(hidden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ibw, err := NewImageByteWriter(flipped, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos := h.Size() + 10
+		if _, err = ibw.Seek(int64(pos), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ibw.Write([]byte{hidden[pos] ^ 0x10}); err != nil {
+			t.Fatal(err)
+		}
+		if data, _, err = decodeAll(flipped, decodeOpts); err == nil || bytes.Equal(data, payload) {
+			t.Errorf("%s: the data decoded although a bit of it was flipped", test.algorithm)
+		}
+	}
+}
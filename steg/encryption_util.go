@@ -0,0 +1,448 @@
+package steg
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// size of the extension stored in the tail
+const extensionLen = 16
+
+// size of the AES key of the data, which is all a key slot holds
+const dataKeySize = 32
+
+// size of the tail: [nonce, timestamp, extension, length, hash]
+const tailSize = 12 + timestampLen + extensionLen + fsizeLen + hashSize
+
+// size of the AES GCM tag
+const gcmTagSize = 16
+
+// the tail is sealed once with a key derived from the data key and stored behind the key slots
+const sealedTailSize = tailSize + gcmTagSize
+const tailHKDFInfo = "stuffer tail key"
+
+type EncryptedImageInformation struct {
+	timestamp time.Time
+	extension string
+	length    uint32
+	hash      []byte
+	gcm       cipher.AEAD
+	nonce     []byte
+	// aad is the authenticated header, nil for legacy padding
+	aad []byte
+	// the key that decrypted the tail
+	keyType KeyType
+	keyBits int
+	// algorithm of the signature block, empty if the data is not signed
+	signature         string
+	signatureVerified bool
+}
+
+func calculateGCMOverhead() (int, error) {
+	cip, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	return gcm.Overhead(), nil
+}
+
+func LoadRSAPublicKey(rsaKeyPath string) (*rsa.PublicKey, error) {
+	publicKey, err := LoadPublicKey(rsaKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not a RSA public key, it is instead %s", reflect.TypeOf(publicKey).String())
+	}
+	return rsaPub, nil
+}
+
+// LoadPublicKey loads a PKIX public key, the result is either a *rsa.PublicKey or a *ecdh.PublicKey for X25519 and P-256 keys
+func LoadPublicKey(keyPath string) (crypto.PublicKey, error) {
+	publicKey, err := readPublicKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, _, err = publicKeyType(publicKey)
+	return publicKey, err
+}
+
+// readPublicKey reads a PKIX public key of any type
+func readPublicKey(keyPath string) (crypto.PublicKey, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %s", err.Error())
+	}
+	pemData, _ := pem.Decode(keyData)
+	if pemData == nil {
+		return nil, fmt.Errorf("failed to parse PEM data")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(pemData.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fauled to parse public key: %s", err.Error())
+	}
+	return publicKey, nil
+}
+
+func LoadRSAPrivateKey(rsaKeyPath string) (*rsa.PrivateKey, error) {
+	return LoadRSAPrivateKeyWithPassphrase(rsaKeyPath, nil)
+}
+
+// LoadRSAPrivateKeyWithPassphrase loads a private key that may be protected by a passphrase (encrypted PKCS#8)
+func LoadRSAPrivateKeyWithPassphrase(rsaKeyPath string, passphrase []byte) (*rsa.PrivateKey, error) {
+	privateKey, err := LoadPrivateKeyWithPassphrase(rsaKeyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	rsaPriv, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not a RSA private key, it is instead %s", reflect.TypeOf(privateKey).String())
+	}
+	return rsaPriv, nil
+}
+
+// LoadPrivateKeyWithPassphrase loads a private key that may be protected by a passphrase (encrypted PKCS#8),
+// the result is either a *rsa.PrivateKey or a *ecdh.PrivateKey for X25519 and P-256 keys
+func LoadPrivateKeyWithPassphrase(keyPath string, passphrase []byte) (crypto.PrivateKey, error) {
+	privateKey, err := readPrivateKey(keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, _, err = privateKeyType(privateKey)
+	return privateKey, err
+}
+
+// readPrivateKey reads a PKCS#1, SEC 1 or PKCS#8 private key of any type, which may be protected by a passphrase
+func readPrivateKey(keyPath string, passphrase []byte) (crypto.PrivateKey, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %s", err.Error())
+	}
+	pemData, _ := pem.Decode(keyData)
+	if pemData == nil {
+		return nil, fmt.Errorf("failed to parse PEM data")
+	}
+	if pemData.Type == "ENCRYPTED PRIVATE KEY" {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		if pemData.Bytes, err = decryptPKCS8(pemData.Bytes, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	var privateKey crypto.PrivateKey
+	switch pemData.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(pemData.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(pemData.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(pemData.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fauled to parse private key: %s", err.Error())
+	}
+	return privateKey, nil
+}
+
+// PublicKeyType returns the type of a key accepted by Options.PublicKey
+func PublicKeyType(pub crypto.PublicKey) (KeyType, error) {
+	_, keyType, err := publicKeyType(pub)
+	return keyType, err
+}
+
+// publicKeyType checks that the key can be used for encryption and returns its type,
+// ECDSA P-256 keys are converted to ECDH keys
+func publicKeyType(pub crypto.PublicKey) (crypto.PublicKey, KeyType, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return key, KEY_RSA, nil
+	case *ecdsa.PublicKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil || ecdhKey.Curve() != ecdh.P256() {
+			return nil, 0, fmt.Errorf("unsupported elliptic curve %s, only P-256 is supported", key.Curve.Params().Name)
+		}
+		return ecdhKey, KEY_P256, nil
+	case *ecdh.PublicKey:
+		keyType, err := ecdhKeyType(key.Curve())
+		return key, keyType, err
+	}
+	return nil, 0, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// privateKeyType is the counterpart of publicKeyType for private keys
+func privateKeyType(priv crypto.PrivateKey) (crypto.PrivateKey, KeyType, error) {
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		return key, KEY_RSA, nil
+	case *ecdsa.PrivateKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil || ecdhKey.Curve() != ecdh.P256() {
+			return nil, 0, fmt.Errorf("unsupported elliptic curve %s, only P-256 is supported", key.Curve.Params().Name)
+		}
+		return ecdhKey, KEY_P256, nil
+	case *ecdh.PrivateKey:
+		keyType, err := ecdhKeyType(key.Curve())
+		return key, keyType, err
+	}
+	return nil, 0, fmt.Errorf("unsupported private key type %T", priv)
+}
+
+// keyBlockSize returns the size of the key block written for the public key
+func keyBlockSize(pub crypto.PublicKey) (int, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if err := checkRSAKeySize(key.Size() * 8); err != nil {
+			return 0, err
+		}
+		return key.Size(), nil
+	case *ecdh.PublicKey:
+		return ecdhBlockSize(key.Curve()), nil
+	}
+	return 0, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// decryptTail decrypts the data key in the key block with the private key and then the sealed tail, the returned information
+// can then be used to decrypt the data itself. aad is the header the data was bound to, nil means the block uses the legacy
+// RSA PKCS#1 v1.5 padding and holds the whole tail instead of the data key
+func decryptTail(priv crypto.PrivateKey, opts *Options, keyType KeyType, keyBlock []byte, sealedTail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	priv, privType, err := privateKeyType(priv)
+	if err != nil {
+		return nil, err
+	}
+	if privType != keyType {
+		return nil, fmt.Errorf("%w: the data was encrypted for a %s key, but the private key is a %s key", ErrWrongKey, keyType, privType)
+	}
+	var block []byte
+	keyBits := 256
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		keyBits = key.Size() * 8
+		block, err = decryptKeyWithRSA(key, opts, keyBlock, aad)
+	case *ecdh.PrivateKey:
+		opts.logf("decrypting data key with %s", keyType)
+		block, err = unwrapKeyWithECDH(key, keyBlock, aad)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info *EncryptedImageInformation
+	if aad == nil {
+		if len(block) < dataKeySize {
+			return nil, fmt.Errorf("%w: tail block is too short: %d bytes", ErrCorrupted, len(block))
+		}
+		info, err = parseTail(opts, block[:dataKeySize], block[dataKeySize:], aad)
+	} else {
+		info, err = openTail(opts, block, sealedTail, aad)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.keyType = keyType
+	info.keyBits = keyBits
+	return info, nil
+}
+
+// decryptKeyWithRSA decrypts the RSA block, aad nil means the block uses the legacy PKCS#1 v1.5 padding
+func decryptKeyWithRSA(rsaPriv *rsa.PrivateKey, opts *Options, keyBlock []byte, aad []byte) ([]byte, error) {
+	if len(keyBlock) != rsaPriv.Size() {
+		return nil, fmt.Errorf("%w: the data was encrypted for a %d bit key, but the private key has %d bits", ErrWrongKey, len(keyBlock)*8, rsaPriv.Size()*8)
+	}
+
+	// decrypt key block
+	var block []byte
+	var err error
+	if aad == nil {
+		opts.logf("decrypting legacy tail with RSA PKCS#1 v1.5")
+		block, err = rsa.DecryptPKCS1v15(rand.Reader, rsaPriv, keyBlock)
+	} else {
+		opts.logf("decrypting data key with RSA-OAEP")
+		block, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaPriv, keyBlock, aad)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt the key block: %s", ErrWrongKey, err.Error())
+	}
+	return block, nil
+}
+
+// tailCipher derives the AES GCM cipher sealing the tail from the data key, it is only used for the tail
+// of a single image, so a zero nonce is fine
+func tailCipher(aesKey []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, aesKey, nil, tailHKDFInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the tail key: %s", err.Error())
+	}
+	cip, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	return gcm, nil
+}
+
+// openTail decrypts the sealed tail with the data key taken from a key slot
+func openTail(opts *Options, aesKey []byte, sealedTail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	if len(aesKey) != dataKeySize {
+		return nil, fmt.Errorf("%w: the data key has %d bytes", ErrCorrupted, len(aesKey))
+	}
+	gcm, err := tailCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := gcm.Open(nil, make([]byte, gcm.NonceSize()), sealedTail, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt the tail: %s", ErrCorrupted, err.Error())
+	}
+	return parseTail(opts, aesKey, tail, aad)
+}
+
+// tail of the data will look like this: [nonce, timestamp, extension, length, hash]
+
+// parseTail reads the decrypted tail and prepares the decryption of the data with the data key
+func parseTail(opts *Options, aesKey []byte, tail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	// prepare aes
+	cip, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	nonceSize := gcm.NonceSize()
+	if len(tail) < nonceSize+28 {
+		return nil, fmt.Errorf("%w: tail block is too short: %d bytes", ErrCorrupted, len(tail))
+	}
+	nonce := tail[:nonceSize]
+	timetampBytes := tail[nonceSize : nonceSize+8]
+	extensionBytes := tail[nonceSize+8 : nonceSize+24]
+	lengthBytes := tail[nonceSize+24 : nonceSize+28]
+	hash := tail[nonceSize+28:]
+	if len(hash) != 32 {
+		return nil, fmt.Errorf("%w: wrong hash length, expected %d, got %d", ErrCorrupted, 32, len(hash))
+	}
+	unixTimestamp := int64(binary.BigEndian.Uint64(timetampBytes))
+	opts.logf("key: %x\tnonce: %x", aesKey, nonce)
+	return &EncryptedImageInformation{
+		timestamp: time.Unix(unixTimestamp, 0),
+		extension: strings.TrimRight(string(extensionBytes), "\x00"),
+		length:    binary.BigEndian.Uint32(lengthBytes),
+		hash:      hash,
+		gcm:       gcm,
+		nonce:     nonce,
+		aad:       aad,
+	}, nil
+}
+
+// decryptData decrypts the data block, which must be exactly info.length bytes long
+func (info *EncryptedImageInformation) decryptData(opts *Options, dataBlock []byte) ([]byte, error) {
+	opts.logf("decrypting data")
+	plainData, err := info.gcm.Open(nil, info.nonce, dataBlock, info.aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt AES: %s", ErrCorrupted, err.Error())
+	}
+	return plainData, nil
+}
+
+// encryptData encrypts the data with AES GCM, seals the tail with a key derived from the data key and encrypts the data key
+// for every public key (RSA-OAEP or ECDH) and the passphrase of the options, all bound to aad. the data is signed first if the
+// options have a signing key. it returns the encrypted data, one key block per public key and passphrase and the sealed tail
+func encryptData(pubs []crypto.PublicKey, opts *Options, data []byte, extension string, hashAndLength []byte, aad []byte) ([]byte, [][]byte, []byte, error) {
+	aesKey := make([]byte, dataKeySize)
+	if n, err := io.ReadFull(rand.Reader, aesKey); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read rand data into AES key (%d out of %d bytes read): %s", n, len(aesKey), err.Error())
+	}
+	cip, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	nonceSize := gcm.NonceSize()
+	nonce := make([]byte, nonceSize)
+	if n, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read rand data into nonce (%d out of %d bytes read): %s", n, len(aesKey), err.Error())
+	}
+	opts.logf("key: %x\tnonce: %x", aesKey, nonce)
+	timestamp := time.Now().Unix()
+	if opts.SigningKey != nil {
+		opts.logf("signing data")
+		signature, err := signData(opts.SigningKey, signatureMessage(hashAndLength[fsizeLen:], timestamp, extension))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		data = append(signature, data...)
+	}
+	opts.logf("encrypting data with AES128")
+	resultAndNonce := gcm.Seal(nonce, nonce, data, aad)
+	aesNonce, aesResult := resultAndNonce[:nonceSize], resultAndNonce[nonceSize:]
+
+	// prepare the tail
+	binary.BigEndian.PutUint32(hashAndLength[:4], uint32(len(aesResult)))
+	var extensionByte [extensionLen]byte
+	var timestampByte [timestampLen]byte
+	copy(extensionByte[:], []byte(extension))
+	binary.BigEndian.PutUint64(timestampByte[:], uint64(timestamp))
+	tail := append(append([]byte{}, aesNonce...), timestampByte[:]...)
+	tail = append(tail, extensionByte[:]...)
+	tail = append(tail, hashAndLength...)
+	tailGCM, err := tailCipher(aesKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sealedTail := tailGCM.Seal(nil, make([]byte, tailGCM.NonceSize()), tail, aad)
+
+	keyBlocks := make([][]byte, len(pubs))
+	for i, pub := range pubs {
+		switch key := pub.(type) {
+		case *rsa.PublicKey:
+			opts.logf("encrypting data key with RSA-OAEP")
+			keyBlocks[i], err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, aad)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to encrypt the data key with RSA: %s", err.Error())
+			}
+		case *ecdh.PublicKey:
+			opts.logf("encrypting data key with ECDH")
+			if keyBlocks[i], err = wrapKeyWithECDH(key, aesKey, aad); err != nil {
+				return nil, nil, nil, err
+			}
+		default:
+			return nil, nil, nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+	}
+	if len(opts.Passphrase) > 0 {
+		opts.logf("encrypting data key with the passphrase")
+		keyBlock, err := wrapKeyWithPassphrase(opts.Passphrase, aesKey, aad)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		keyBlocks = append(keyBlocks, keyBlock)
+	}
+	return aesResult, keyBlocks, sealedTail, nil
+}
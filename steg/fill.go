@@ -0,0 +1,120 @@
+package steg
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/bits"
+	randv2 "math/rand/v2"
+	"strings"
+)
+
+// FillMode selects what is written to the hidden bytes behind the data. without filling they keep the bits of the
+// source image, so the end of the data is visible as a change in the statistics of the lowest bits
+type FillMode byte
+
+const (
+	FILL_NONE FillMode = iota
+	// FILL_RANDOM overwrites the unused bytes with random bits
+	FILL_RANDOM
+	// FILL_COVER overwrites the unused bytes with random bits that have the same share of ones as the replaced bits,
+	// measured in blocks of fillBlockSize bytes. e.g. the lowest bits of flat or clipped areas stay as they are
+	FILL_COVER
+)
+
+// number of hidden bytes whose share of ones is kept by FILL_COVER
+const fillBlockSize = 64
+
+func (m FillMode) String() string {
+	switch m {
+	case FILL_NONE:
+		return "none"
+	case FILL_RANDOM:
+		return "random"
+	case FILL_COVER:
+		return "cover"
+	}
+	return fmt.Sprintf("unknown fill mode %d", m)
+}
+
+// ParseFillMode parses the fill mode names used by the command line, "none", "random" and "cover"
+func ParseFillMode(name string) (FillMode, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return FILL_NONE, nil
+	case "random":
+		return FILL_RANDOM, nil
+	case "cover":
+		return FILL_COVER, nil
+	}
+	return 0, fmt.Errorf("unsupported fill mode %s, it must be none, random or cover", name)
+}
+
+// noiseFiller generates the noise of a fill mode, from a ChaCha8 generator with a random key
+type noiseFiller struct {
+	mode FillMode
+	rng  *randv2.ChaCha8
+}
+
+func newNoiseFiller(mode FillMode) (*noiseFiller, error) {
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, fmt.Errorf("failed to seed the noise generator: %s", err.Error())
+	}
+	return &noiseFiller{mode: mode, rng: randv2.NewChaCha8(seed)}, nil
+}
+
+// fill replaces the bytes with noise, FILL_COVER uses the bytes to shape it
+func (f *noiseFiller) fill(data []byte) {
+	if f.mode == FILL_RANDOM {
+		f.rng.Read(data)
+		return
+	}
+	for from := 0; from < len(data); from += fillBlockSize {
+		block := data[from:min(from+fillBlockSize, len(data))]
+		ones := 0
+		for _, b := range block {
+			ones += bits.OnesCount8(b)
+		}
+		if ones == 0 || ones == len(block)*8 {
+			continue
+		}
+		// a bit is set if a random number is lower than the share of ones
+		threshold := uint64(ones) * (1 << 32) / uint64(len(block)*8)
+		for i := range block {
+			var b byte
+			for j := 0; j < 8; j += 2 {
+				r := f.rng.Uint64()
+				if r&0xffffffff < threshold {
+					b |= 1 << j
+				}
+				if r>>32 < threshold {
+					b |= 2 << j
+				}
+			}
+			block[i] = b
+		}
+	}
+}
+
+// fillUnused fills the hidden bytes of the image from byte offset from up to the capacity with noise
+func fillUnused(ctx context.Context, ibw *ImageByteWriter, from int, mode FillMode) error {
+	filler, err := newNoiseFiller(mode)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for off := from; off < ibw.Capacity(); off += len(buf) {
+		chunk := buf[:min(len(buf), ibw.Capacity()-off)]
+		if mode == FILL_COVER {
+			if err = ibw.bits.readBytes(ctx, chunk, off*8); err != nil {
+				return err
+			}
+		}
+		filler.fill(chunk)
+		if err = ibw.bits.writeBytes(ctx, chunk, off*8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
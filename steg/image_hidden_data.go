@@ -0,0 +1,820 @@
+package steg
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	randv2 "math/rand/v2"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type WritableImage interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}
+
+// maximum number of least significant bits of each channel that can be used
+const MAX_BITS = 4
+
+// embed a bit into a channel value (set the bit at plane, counted from the least significant bit, to the value)
+func bitEmbed(v uint16, plane int, bit bool) uint16 {
+	if bit {
+		return v | (1 << plane)
+	} else {
+		return v & (^uint16(1 << plane))
+	}
+}
+
+// bitMatch embeds a bit like bitEmbed, but if the bit has to change it adds or subtracts 1<<plane instead of replacing the bit
+// (LSB matching), which keeps the lower bits and avoids the pairs of values that steganalysis of LSB replacement looks for.
+// up picks the direction, unless the value would leave [low, high]. the change can carry into the higher bits, so it is only
+// used for the highest bit of the layout, the lower hidden bits are replaced
+func bitMatch(v uint16, plane int, bit bool, up bool, low int, high int) uint16 {
+	if (v&(1<<plane) != 0) == bit {
+		return v
+	}
+	step := 1 << plane
+	if up && int(v)+step <= high || int(v)-step < low {
+		return v + uint16(step)
+	}
+	return v - uint16(step)
+}
+
+// coinFlips hands out random bits for the direction of LSB matching, one random number per 64 flips
+type coinFlips struct {
+	bits uint64
+	n    int
+}
+
+func (f *coinFlips) next() bool {
+	if f.n == 0 {
+		f.bits = randv2.Uint64()
+		f.n = 64
+	}
+	f.n--
+	up := f.bits&1 != 0
+	f.bits >>= 1
+	return up
+}
+
+// Layout describes which bits of the image pixels hold the hidden data
+type Layout struct {
+	// number of least significant bits used in each channel
+	Bits int
+	// whether the alpha channel is used as well, fully transparent pixels are skipped in that case
+	Alpha bool
+}
+
+func (l Layout) String() string {
+	if l.Alpha {
+		return fmt.Sprintf("%d bit(s) per channel, including alpha", l.Bits)
+	}
+	return fmt.Sprintf("%d bit(s) per channel", l.Bits)
+}
+
+// candidateLayouts returns all layouts the image could have been encoded with, most common first
+func candidateLayouts(im image.Image) []Layout {
+	var layouts []Layout
+	for bits := 1; bits <= MAX_BITS; bits++ {
+		for _, alpha := range []bool{false, true} {
+			layout := Layout{Bits: bits, Alpha: alpha}
+			if checkLayout(im, layout) == nil {
+				layouts = append(layouts, layout)
+			}
+		}
+	}
+	return layouts
+}
+
+func checkLayout(im image.Image, layout Layout) error {
+	if layout.Bits < 1 || layout.Bits > MAX_BITS {
+		return fmt.Errorf("invalid number of bits per channel %d, valid 1-%d", layout.Bits, MAX_BITS)
+	}
+	if _, ok := im.(*image.Paletted); ok && layout.Bits != 1 {
+		return fmt.Errorf("paletted images only support 1 bit per channel")
+	}
+	_, err := channelCount(im, layout.Alpha)
+	return err
+}
+
+// channelCount returns how many channels of each pixel can be used for hidden bits
+func channelCount(im image.Image, alpha bool) (int, error) {
+	colorModel := im.ColorModel()
+	if alpha {
+		switch colorModel {
+		case color.NRGBAModel, color.NRGBA64Model:
+			return 4, nil
+		case color.RGBAModel, color.RGBA64Model:
+			return 0, fmt.Errorf("the alpha channel of premultiplied RGBA images cannot be used")
+		default:
+			return 0, fmt.Errorf("the image has no alpha channel")
+		}
+	}
+	switch colorModel {
+	case color.RGBAModel, color.NRGBAModel, color.RGBA64Model, color.NRGBA64Model:
+		return 3, nil
+	case color.GrayModel, color.Gray16Model:
+		return 1, nil
+	}
+	if palette, ok := colorModel.(color.Palette); ok {
+		if _, ok = im.(*image.Paletted); !ok {
+			return 0, fmt.Errorf("unsupported paletted image type %T", im)
+		}
+		if len(palette) < 2 {
+			return 0, fmt.Errorf("palette needs at least 2 colors, has %d", len(palette))
+		}
+		return 1, nil
+	}
+	return 0, fmt.Errorf("expected a RGB, grayscale or paletted image")
+}
+
+// maxChannelValue returns the largest channel value of the image, for paletted images the largest rank
+func maxChannelValue(im image.Image) int {
+	switch colorModel := im.ColorModel().(type) {
+	case color.Palette:
+		return len(colorModel) - 1
+	}
+	switch im.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return 0xffff
+	}
+	return 0xff
+}
+
+// changing the last bit of a palette index could result in a completely different color,
+// so for paletted images the palette is sorted and the hidden bit is stored in the last bit
+// of the index's rank instead, swapping the color with its partner (see paletteAccess).
+// colors are only paired with a color of the same alpha, the most similar by luminance, so that
+// embedding never changes the transparency of a pixel. colors left without a partner are ranked
+// last and pixels of these colors do not hold hidden bits
+type PaletteOrder struct {
+	rank    []int
+	indexes []uint8
+	// number of ranks which belong to a pair, the ranks from paired on have no partner
+	paired int
+}
+
+func NewPaletteOrder(palette color.Palette) *PaletteOrder {
+	po := &PaletteOrder{rank: make([]int, len(palette))}
+	luminance := make([]uint32, len(palette))
+	alpha := make([]uint32, len(palette))
+	sorted := make([]uint8, len(palette))
+	for i, c := range palette {
+		r, g, b, a := c.RGBA()
+		luminance[i] = 299*(r>>8) + 587*(g>>8) + 114*(b>>8)
+		alpha[i] = a
+		sorted[i] = uint8(i)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if alpha[a] != alpha[b] {
+			return alpha[a] > alpha[b]
+		}
+		return luminance[a] < luminance[b]
+	})
+	var unpaired []uint8
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && alpha[sorted[end]] == alpha[sorted[start]] {
+			end++
+		}
+		group := sorted[start:end]
+		if len(group)%2 == 0 {
+			po.indexes = append(po.indexes, group...)
+		} else {
+			odd := oddColor(group, luminance)
+			po.indexes = append(po.indexes, group[:odd]...)
+			po.indexes = append(po.indexes, group[odd+1:]...)
+			unpaired = append(unpaired, group[odd])
+		}
+		start = end
+	}
+	po.paired = len(po.indexes)
+	po.indexes = append(po.indexes, unpaired...)
+	for rank, idx := range po.indexes {
+		po.rank[idx] = rank
+	}
+	return po
+}
+
+// oddColor returns the position of the color that is left without a partner in an odd sized group
+// of colors sorted by luminance, picking the one that makes the remaining pairs the most similar
+func oddColor(group []uint8, luminance []uint32) int {
+	best, bestCost := 0, uint32(math.MaxUint32)
+	// the remaining colors are paired with their neighbours, so only every second color can be left out
+	for odd := 0; odd < len(group); odd += 2 {
+		var cost uint32
+		for i := 0; i < odd; i += 2 {
+			cost += luminance[group[i+1]] - luminance[group[i]]
+		}
+		for i := odd + 1; i < len(group); i += 2 {
+			cost += luminance[group[i+1]] - luminance[group[i]]
+		}
+		if cost < bestCost {
+			best, bestCost = odd, cost
+		}
+	}
+	return best
+}
+
+// bytes read or written by a single goroutine, a multiple of 3 so that chunks always start
+// at the beginning of a channel value for any number of bits per channel
+const chunkSize = 3 * 64 * 1024
+
+// number of pixels per entry of the index of usable pixels, which is used to locate bit positions when pixels are skipped
+const pixelBlockSize = 64
+
+// imageBits addresses the bits of an image that can hold hidden data.
+// the position of a bit is ((pixel * channels) + channel) * bits + plane,
+// where pixel counts only the pixels which can hold hidden bits
+type imageBits struct {
+	acc      channelAccess
+	layout   Layout
+	channels int
+	w        int
+	h        int
+	pixels   int
+	// LSB matching instead of LSB replacement when writing, see bitMatch
+	matching bool
+	maxValue int
+	// number of usable pixels before each block of pixelBlockSize pixels, only set if pixels are skipped
+	blockStart []int
+	// palette order of paletted images with colors that have no partner, their pixels are skipped
+	order *PaletteOrder
+}
+
+func newImageBits(im image.Image, layout Layout) (*imageBits, error) {
+	channels, err := channelCount(im, layout.Alpha)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkLayout(im, layout); err != nil {
+		return nil, err
+	}
+	acc, err := newChannelAccess(im)
+	if err != nil {
+		return nil, err
+	}
+	ib := &imageBits{
+		acc:      acc,
+		layout:   layout,
+		channels: channels,
+		w:        im.Bounds().Dx(),
+		h:        im.Bounds().Dy(),
+		maxValue: maxChannelValue(im),
+	}
+	ib.pixels = ib.w * ib.h
+	if pa, ok := ib.acc.(*paletteAccess); ok && pa.order.paired < len(pa.order.indexes) {
+		ib.order = pa.order
+	}
+	if layout.Alpha || ib.order != nil {
+		// count the usable pixels in each block, so that bit positions can be located quickly
+		total := ib.w * ib.h
+		ib.blockStart = make([]int, (total+pixelBlockSize-1)/pixelBlockSize+1)
+		for i := 0; i < total; i++ {
+			if i%pixelBlockSize == 0 {
+				ib.blockStart[i/pixelBlockSize+1] = ib.blockStart[i/pixelBlockSize]
+			}
+			if ib.usablePixel(i%ib.w, i/ib.w) {
+				ib.blockStart[i/pixelBlockSize+1]++
+			}
+		}
+		ib.pixels = ib.blockStart[len(ib.blockStart)-1]
+	}
+	return ib, nil
+}
+
+// usablePixel reports whether the pixel can hold hidden bits. when using the alpha channel, fully transparent
+// pixels are skipped (ignoring the alpha bits which may hold hidden data), since their color is meaningless
+// and often discarded by image tools. pixels of paletted images are skipped if their color has no partner
+func (ib *imageBits) usablePixel(x, y int) bool {
+	if ib.order != nil {
+		return int(ib.acc.get(x, y, 0)) < ib.order.paired
+	}
+	return !ib.layout.Alpha || ib.acc.get(x, y, 3)>>ib.layout.Bits != 0
+}
+
+// minValue returns the smallest value LSB matching may write to the channel. the alpha channel must keep a bit above
+// the hidden bits set, otherwise the pixel would become unusable (see usablePixel)
+func (ib *imageBits) minValue(channel int) int {
+	if ib.layout.Alpha && channel == 3 {
+		return 1 << ib.layout.Bits
+	}
+	return 0
+}
+
+// bitCount returns the number of bits that can hold hidden data
+func (ib *imageBits) bitCount() int {
+	return ib.pixels * ib.channels * ib.layout.Bits
+}
+
+// capacity returns the number of hidden bytes the image can hold
+func (ib *imageBits) capacity() int {
+	return ib.bitCount() / 8
+}
+
+type bitCursor struct {
+	ib      *imageBits
+	x       int
+	y       int
+	pixel   int
+	channel int
+	plane   int
+}
+
+// cursor returns a cursor pointing at bitpos, which must be lower than bitCount
+func (ib *imageBits) cursor(bitpos int) bitCursor {
+	c := bitCursor{ib: ib}
+	c.plane = bitpos % ib.layout.Bits
+	bitpos /= ib.layout.Bits
+	c.channel = bitpos % ib.channels
+	bitpos /= ib.channels
+	c.pixel = bitpos
+	if ib.blockStart == nil {
+		c.x = bitpos % ib.w
+		c.y = bitpos / ib.w
+		return c
+	}
+	block := sort.Search(len(ib.blockStart)-1, func(b int) bool {
+		return ib.blockStart[b+1] > bitpos
+	})
+	skip := bitpos - ib.blockStart[block]
+	for i := block * pixelBlockSize; ; i++ {
+		c.x, c.y = i%ib.w, i/ib.w
+		if ib.usablePixel(c.x, c.y) {
+			if skip == 0 {
+				break
+			}
+			skip--
+		}
+	}
+	return c
+}
+
+// next moves the cursor to the next bit, it must not be called on the last bit
+func (c *bitCursor) next() {
+	c.plane++
+	if c.plane < c.ib.layout.Bits {
+		return
+	}
+	c.plane = 0
+	c.channel++
+	if c.channel < c.ib.channels {
+		return
+	}
+	c.channel = 0
+	c.pixel++
+	for {
+		c.x++
+		if c.x >= c.ib.w {
+			c.x = 0
+			c.y++
+		}
+		if c.y >= c.ib.h || c.ib.usablePixel(c.x, c.y) {
+			return
+		}
+	}
+}
+
+func (c *bitCursor) bit() bool {
+	return c.ib.acc.get(c.x, c.y, c.channel)&(1<<c.plane) != 0
+}
+
+// setBit embeds the bit, the coin flips are only used for LSB matching
+func (c *bitCursor) setBit(bit bool, flips *coinFlips) {
+	v := c.ib.acc.get(c.x, c.y, c.channel)
+	var nv uint16
+	if c.ib.matching && c.plane == c.ib.layout.Bits-1 {
+		nv = bitMatch(v, c.plane, bit, flips.next(), c.ib.minValue(c.channel), c.ib.maxValue)
+	} else {
+		nv = bitEmbed(v, c.plane, bit)
+	}
+	if nv != v {
+		c.ib.acc.set(c.x, c.y, c.channel, nv)
+	}
+}
+
+// forEachChunk splits the n bytes starting at the byte aligned bitpos into chunks and calls fn for each of them
+// with a cursor at the start of the chunk. chunks never share a channel value, so they are processed in parallel
+// if the image allows it. the context is checked before every chunk
+func (ib *imageBits) forEachChunk(ctx context.Context, bitpos int, n int, fn func(c bitCursor, from int, to int)) error {
+	if n <= 0 {
+		return nil
+	}
+	if n <= chunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fn(ib.cursor(bitpos), 0, n)
+		return nil
+	}
+	// all cursors are created before any goroutine starts writing, since locating a pixel may read other pixels
+	type chunk struct {
+		c        bitCursor
+		from, to int
+	}
+	var chunks []chunk
+	for from := 0; from < n; {
+		// align the chunk ends to absolute multiples of chunkSize
+		to := ((bitpos/8+from)/chunkSize+1)*chunkSize - bitpos/8
+		if to > n {
+			to = n
+		}
+		chunks = append(chunks, chunk{c: ib.cursor(bitpos + from*8), from: from, to: to})
+		from = to
+	}
+	if !concurrentAccess(ib.acc) {
+		for _, ch := range chunks {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			fn(ch.c, ch.from, ch.to)
+		}
+		return nil
+	}
+	work := make(chan chunk)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range work {
+				fn(ch.c, ch.from, ch.to)
+			}
+		}()
+	}
+	var err error
+	for _, ch := range chunks {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		work <- ch
+	}
+	close(work)
+	wg.Wait()
+	return err
+}
+
+// pixWalker walks the channel values of 8 bit images directly in their Pix slice, which is a lot faster than
+// a bitCursor. it is only used when no pixels are skipped, so that the channel values are evenly spaced
+type pixWalker struct {
+	pix      []uint8
+	off      int
+	rowEnd   int
+	stride   int
+	step     int
+	rowWidth int
+	channels int
+	bits     int
+	channel  int
+	plane    int
+	matching bool
+	maxValue int
+}
+
+func (ib *imageBits) pixWalker(c bitCursor) (*pixWalker, bool) {
+	a, ok := ib.acc.(*pixAccess8)
+	if !ok || ib.layout.Alpha {
+		return nil, false
+	}
+	return &pixWalker{
+		pix:      a.pix,
+		off:      c.y*a.stride + c.x*a.step + c.channel,
+		rowEnd:   c.y*a.stride + ib.w*a.step,
+		stride:   a.stride,
+		step:     a.step,
+		rowWidth: ib.w * a.step,
+		channels: ib.channels,
+		bits:     ib.layout.Bits,
+		channel:  c.channel,
+		plane:    c.plane,
+		matching: ib.matching,
+		maxValue: ib.maxValue,
+	}, true
+}
+
+func (w *pixWalker) next() {
+	w.plane++
+	if w.plane < w.bits {
+		return
+	}
+	w.plane = 0
+	w.channel++
+	w.off++
+	if w.channel < w.channels {
+		return
+	}
+	w.channel = 0
+	w.off += w.step - w.channels
+	if w.off >= w.rowEnd {
+		w.rowEnd += w.stride
+		w.off = w.rowEnd - w.rowWidth
+	}
+}
+
+func (w *pixWalker) readBytes(dst []byte) {
+	for i := range dst {
+		var b byte
+		for j := 0; j < 8; j++ {
+			b |= (w.pix[w.off] >> w.plane & 1) << j
+			w.next()
+		}
+		dst[i] = b
+	}
+}
+
+func (w *pixWalker) writeBytes(src []byte) {
+	if w.matching {
+		var flips coinFlips
+		for _, b := range src {
+			for j := 0; j < 8; j++ {
+				if w.plane == w.bits-1 {
+					w.pix[w.off] = uint8(bitMatch(uint16(w.pix[w.off]), w.plane, b>>j&1 != 0, flips.next(), 0, w.maxValue))
+				} else {
+					w.pix[w.off] = w.pix[w.off]&^(1<<w.plane) | (b>>j&1)<<w.plane
+				}
+				w.next()
+			}
+		}
+		return
+	}
+	for _, b := range src {
+		for j := 0; j < 8; j++ {
+			w.pix[w.off] = w.pix[w.off]&^(1<<w.plane) | (b>>j&1)<<w.plane
+			w.next()
+		}
+	}
+}
+
+// readBytes fills dst with the hidden bytes starting at the byte aligned bitpos
+func (ib *imageBits) readBytes(ctx context.Context, dst []byte, bitpos int) error {
+	return ib.forEachChunk(ctx, bitpos, len(dst), func(c bitCursor, from int, to int) {
+		if w, ok := ib.pixWalker(c); ok {
+			w.readBytes(dst[from:to])
+			return
+		}
+		for i := from; i < to; i++ {
+			var b byte
+			for j := 0; j < 8; j++ {
+				if i > from || j > 0 {
+					c.next()
+				}
+				if c.bit() {
+					b |= 1 << j
+				}
+			}
+			dst[i] = b
+		}
+	})
+}
+
+// writeBytes embeds src into the hidden bits starting at the byte aligned bitpos
+func (ib *imageBits) writeBytes(ctx context.Context, src []byte, bitpos int) error {
+	return ib.forEachChunk(ctx, bitpos, len(src), func(c bitCursor, from int, to int) {
+		if w, ok := ib.pixWalker(c); ok {
+			w.writeBytes(src[from:to])
+			return
+		}
+		var flips coinFlips
+		for i := from; i < to; i++ {
+			for j := 0; j < 8; j++ {
+				if i > from || j > 0 {
+					c.next()
+				}
+				c.setBit(src[i]&(1<<j) != 0, &flips)
+			}
+		}
+	})
+}
+
+type ImageByteWriter struct {
+	im     WritableImage
+	bits   *imageBits
+	bitPos int
+	ctx    context.Context
+}
+
+// NewImageByteWriter creates a writer that embeds data into the lowest bits of every channel
+func NewImageByteWriter(im WritableImage, layout Layout) (*ImageByteWriter, error) {
+	bits, err := newImageBits(im, layout)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageByteWriter{
+		im:     im,
+		bits:   bits,
+		bitPos: 0,
+		ctx:    context.Background(),
+	}, nil
+}
+
+func (ibw *ImageByteWriter) Write(data []byte) (int, error) {
+	var err error = nil
+	if available := (ibw.bits.bitCount() - ibw.bitPos) / 8; available < len(data) {
+		err = io.EOF
+		data = data[:available]
+	}
+	if err := ibw.bits.writeBytes(ibw.ctx, data, ibw.bitPos); err != nil {
+		return 0, err
+	}
+	ibw.bitPos += len(data) * 8
+	return len(data), err
+}
+
+func (ibw *ImageByteWriter) setBitPos(bitpos int) error {
+	if bitpos < 0 {
+		bitpos = 0
+	}
+	if bitpos >= ibw.bits.bitCount() {
+		ibw.bitPos = ibw.bits.bitCount()
+		return io.EOF
+	}
+	ibw.bitPos = bitpos
+	return nil
+}
+
+func (ibw *ImageByteWriter) BitPos() int {
+	return ibw.bitPos
+}
+
+func (ibw *ImageByteWriter) Seek(offset int64, whence int) (int64, error) {
+	var currentPos int64
+	switch whence {
+	case io.SeekCurrent:
+		currentPos = int64(ibw.BitPos()) / 8
+	case io.SeekStart:
+		currentPos = 0
+	case io.SeekEnd:
+		currentPos = int64(ibw.Capacity())
+	default:
+		return -1, fmt.Errorf("unknown seek whence")
+	}
+	currentPos += offset
+	err := ibw.setBitPos(int(currentPos) * 8)
+	return int64(ibw.BitPos() / 8), err
+}
+
+func (ibw *ImageByteWriter) Image() WritableImage {
+	return ibw.im
+}
+
+// ImageByteReader reads the hidden bytes of an image, using the same bit addressing as ImageByteWriter.
+// it implements io.Reader, io.ReaderAt and io.Seeker, so only the parts of the image that are needed
+// are decoded and the hidden data can be treated like a file of Size bytes
+type ImageByteReader struct {
+	im     image.Image
+	bits   *imageBits
+	bitPos int
+	ctx    context.Context
+}
+
+func NewImageByteReader(im image.Image, layout Layout) (*ImageByteReader, error) {
+	bits, err := newImageBits(im, layout)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageByteReader{
+		im:     im,
+		bits:   bits,
+		bitPos: 0,
+		ctx:    context.Background(),
+	}, nil
+}
+
+func (ibr *ImageByteReader) Read(data []byte) (int, error) {
+	available := (ibr.bits.bitCount() - ibr.bitPos) / 8
+	if available <= 0 {
+		return 0, io.EOF
+	}
+	if available < len(data) {
+		data = data[:available]
+	}
+	if err := ibr.bits.readBytes(ibr.ctx, data, ibr.bitPos); err != nil {
+		return 0, err
+	}
+	ibr.bitPos += len(data) * 8
+	return len(data), nil
+}
+
+// ReadAt reads the hidden bytes starting at byte offset off, without changing the position used by Read and Seek
+func (ibr *ImageByteReader) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= ibr.Size() {
+		return 0, io.EOF
+	}
+	var err error = nil
+	if available := ibr.Size() - off; available < int64(len(data)) {
+		err = io.EOF
+		data = data[:available]
+	}
+	if err := ibr.bits.readBytes(ibr.ctx, data, int(off)*8); err != nil {
+		return 0, err
+	}
+	return len(data), err
+}
+
+// setBitPos moves to the bit position, positions past the end are allowed and make Read return io.EOF
+func (ibr *ImageByteReader) setBitPos(bitpos int) error {
+	if bitpos < 0 {
+		return fmt.Errorf("negative position")
+	}
+	ibr.bitPos = bitpos
+	return nil
+}
+
+func (ibr *ImageByteReader) BitPos() int {
+	return ibr.bitPos
+}
+
+func (ibr *ImageByteReader) Seek(offset int64, whence int) (int64, error) {
+	var currentPos int64
+	switch whence {
+	case io.SeekCurrent:
+		currentPos = int64(ibr.BitPos()) / 8
+	case io.SeekStart:
+		currentPos = 0
+	case io.SeekEnd:
+		currentPos = ibr.Size()
+	default:
+		return -1, fmt.Errorf("unknown seek whence")
+	}
+	currentPos += offset
+	if err := ibr.setBitPos(int(currentPos) * 8); err != nil {
+		return int64(ibr.BitPos() / 8), err
+	}
+	return currentPos, nil
+}
+
+// Capacity returns the number of hidden bytes the image can hold
+func (ibr *ImageByteReader) Capacity() int {
+	return ibr.bits.capacity()
+}
+
+// Size returns the number of hidden bytes the image can hold, like bytes.Reader and io.SectionReader do
+func (ibr *ImageByteReader) Size() int64 {
+	return int64(ibr.bits.capacity())
+}
+
+// Image returns the image the hidden bytes are read from
+func (ibr *ImageByteReader) Image() image.Image {
+	return ibr.im
+}
+
+// EnsureWritableImage returns the image itself if the hidden data can be embedded into it directly,
+// otherwise (e.g. YCbCr images decoded from JPEG or CMYK images) a NRGBA copy is returned.
+// the second return value reports whether the image was converted
+func EnsureWritableImage(im image.Image, layout Layout) (WritableImage, bool) {
+	b := im.Bounds()
+	if layout.Alpha {
+		// the alpha of premultiplied colors cannot be changed on its own, convert them to their non-premultiplied equivalent
+		switch im.(type) {
+		case *image.RGBA:
+			nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(nrgba, nrgba.Bounds(), im, b.Min, draw.Src)
+			return nrgba, true
+		case *image.RGBA64:
+			nrgba64 := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(nrgba64, nrgba64.Bounds(), im, b.Min, draw.Src)
+			return nrgba64, true
+		}
+	}
+	if wi, ok := im.(WritableImage); ok {
+		if _, err := channelCount(wi, false); err == nil {
+			return wi, false
+		}
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), im, b.Min, draw.Src)
+	return nrgba, true
+}
+
+// GetHiddenBytesFromImage reads all of the hidden bytes of the image at once, use ImageByteReader
+// to read only a part of them
+func GetHiddenBytesFromImage(im image.Image, layout Layout) ([]byte, error) {
+	return getHiddenBytes(context.Background(), im, layout)
+}
+
+func getHiddenBytes(ctx context.Context, im image.Image, layout Layout) ([]byte, error) {
+	ibr, err := NewImageByteReader(im, layout)
+	if err != nil {
+		return nil, err
+	}
+	ibr.ctx = ctx
+	hiddenData := make([]byte, ibr.Size())
+	if _, err = ibr.ReadAt(hiddenData, 0); err != nil && len(hiddenData) > 0 {
+		return nil, err
+	}
+	return hiddenData, nil
+}
+
+func (ibw *ImageByteWriter) Capacity() int {
+	return ibw.bits.capacity()
+}
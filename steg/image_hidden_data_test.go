@@ -0,0 +1,438 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"io"
+	randv2 "math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// genericImage hides the concrete type of the image, so that its channels are accessed through At and Set
+type genericImage struct {
+	WritableImage
+}
+
+// rgba64Image returns its colors as color.RGBA64 instead of the type of its color model
+type rgba64Image struct {
+	WritableImage
+}
+
+func (im rgba64Image) At(x, y int) color.Color {
+	return color.RGBA64Model.Convert(im.WritableImage.At(x, y))
+}
+
+// testImage returns an image of the kind filled with random colors, the same seed always gives the same image.
+// images with an alpha channel get fully transparent and nearly transparent pixels as well
+func testImage(kind string, w, h int, seed uint64) WritableImage {
+	rng := randv2.New(randv2.NewPCG(seed, 1))
+	alpha := func() uint16 {
+		switch rng.IntN(8) {
+		case 0:
+			return 0
+		case 1:
+			return uint16(rng.IntN(32))
+		}
+		return uint16(rng.Uint32())
+	}
+	rect := image.Rect(3, 5, 3+w, 5+h)
+	var im WritableImage
+	switch kind {
+	case "rgba":
+		im = image.NewRGBA(rect)
+	case "nrgba":
+		im = image.NewNRGBA(rect)
+	case "rgba64":
+		im = image.NewRGBA64(rect)
+	case "nrgba64":
+		im = image.NewNRGBA64(rect)
+	case "gray":
+		im = image.NewGray(rect)
+	case "gray16":
+		im = image.NewGray16(rect)
+	case "paletted":
+		im = image.NewPaletted(rect, palette.Plan9[:255])
+	default:
+		panic("unknown image kind " + kind)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			r, g, b := uint16(rng.Uint32()), uint16(rng.Uint32()), uint16(rng.Uint32())
+			switch kind {
+			case "rgba":
+				// premultiplied colors are only valid with an opaque alpha here
+				im.Set(x, y, color.RGBA{uint8(r), uint8(g), uint8(b), 0xff})
+			case "nrgba":
+				im.Set(x, y, color.NRGBA{uint8(r), uint8(g), uint8(b), uint8(alpha())})
+			case "rgba64":
+				im.Set(x, y, color.RGBA64{r, g, b, 0xffff})
+			case "nrgba64":
+				im.Set(x, y, color.NRGBA64{r, g, b, alpha()})
+			case "gray":
+				im.Set(x, y, color.Gray{uint8(r)})
+			case "gray16":
+				im.Set(x, y, color.Gray16{r})
+			case "paletted":
+				im.(*image.Paletted).SetColorIndex(x, y, uint8(rng.IntN(255)))
+			}
+		}
+	}
+	return im
+}
+
+// referenceHiddenBytes extracts the hidden bytes pixel by pixel, the way the bits are addressed by imageBits
+func referenceHiddenBytes(t testing.TB, im image.Image, layout Layout) []byte {
+	channels, err := channelCount(im, layout.Alpha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order *PaletteOrder
+	if p, ok := im.(*image.Paletted); ok {
+		order = NewPaletteOrder(p.Palette)
+	}
+	var data []byte
+	n := 0
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if order != nil && order.rank[im.(*image.Paletted).ColorIndexAt(x, y)] >= order.paired {
+				// colors without a partner do not hold hidden bits
+				continue
+			}
+			values := make([]uint16, channels)
+			for ch := range values {
+				if order != nil {
+					values[ch] = uint16(order.rank[im.(*image.Paletted).ColorIndexAt(x, y)])
+				} else {
+					values[ch] = colorChannel(im.At(x, y), ch)
+				}
+			}
+			if layout.Alpha && values[3]>>layout.Bits == 0 {
+				continue
+			}
+			for _, v := range values {
+				for plane := 0; plane < layout.Bits; plane++ {
+					if n%8 == 0 {
+						data = append(data, 0)
+					}
+					data[n/8] |= byte(v>>plane&1) << (n % 8)
+					n++
+				}
+			}
+		}
+	}
+	return data[:n/8]
+}
+
+type hiddenDataTest struct {
+	kind   string
+	w, h   int
+	layout Layout
+}
+
+// the images hold more than chunkSize hidden bytes, so that the data is processed in several chunks
+var hiddenDataTests = []hiddenDataTest{
+	{"nrgba", 1024, 520, Layout{Bits: 1}},
+	{"nrgba", 1024, 520, Layout{Bits: 2, Alpha: true}},
+	{"nrgba", 1024, 520, Layout{Bits: 3}},
+	{"rgba", 1024, 520, Layout{Bits: 1}},
+	{"nrgba64", 1024, 520, Layout{Bits: 1}},
+	{"nrgba64", 1024, 520, Layout{Bits: 4, Alpha: true}},
+	{"rgba64", 1024, 520, Layout{Bits: 2}},
+	{"gray", 1024, 1600, Layout{Bits: 1}},
+	{"gray", 1024, 520, Layout{Bits: 3}},
+	{"gray16", 1024, 1600, Layout{Bits: 1}},
+	{"paletted", 1024, 1600, Layout{Bits: 1}},
+}
+
+func (test hiddenDataTest) String() string {
+	return fmt.Sprintf("%s %dx%d %d bits alpha %t", test.kind, test.w, test.h, test.layout.Bits, test.layout.Alpha)
+}
+
+func TestReadHiddenBytes(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range hiddenDataTests {
+		t.Run(test.String(), func(t *testing.T) {
+			im := testImage(test.kind, test.w, test.h, 1)
+			expected := referenceHiddenBytes(t, im, test.layout)
+			if len(expected) <= chunkSize {
+				t.Fatalf("the image only holds %d bytes, not more than a chunk", len(expected))
+			}
+			images := []image.Image{im}
+			if test.kind != "paletted" {
+				// paletted images are always accessed through their color indexes
+				images = append(images, genericImage{im})
+			}
+			for _, im := range images {
+				data, err := getHiddenBytes(ctx, im, test.layout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, expected) {
+					t.Errorf("%T: hidden bytes differ from the reference", im)
+				}
+				// reads which start and end inside of chunks
+				ibr, err := NewImageByteReader(im, test.layout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				part := make([]byte, chunkSize+1001)
+				if _, err = ibr.ReadAt(part, 777); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(part, expected[777:777+len(part)]) {
+					t.Errorf("%T: hidden bytes at offset 777 differ from the reference", im)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteHiddenBytes(t *testing.T) {
+	for _, test := range hiddenDataTests {
+		t.Run(test.String(), func(t *testing.T) {
+			// the data starts and ends inside of chunks
+			data := make([]byte, chunkSize+1001)
+			randv2.NewChaCha8([32]byte{2}).Read(data)
+			offset := 777
+			fast := testImage(test.kind, test.w, test.h, 1)
+			images := []WritableImage{fast}
+			if test.kind != "paletted" {
+				images = append(images, genericImage{testImage(test.kind, test.w, test.h, 1)})
+			}
+			expected := referenceHiddenBytes(t, fast, test.layout)
+			copy(expected[offset:], data)
+			for _, im := range images {
+				ibw, err := NewImageByteWriter(im, test.layout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = ibw.Seek(int64(offset), 0); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = ibw.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(referenceHiddenBytes(t, im, test.layout), expected) {
+					t.Errorf("%T: hidden bytes differ from the written data", im)
+				}
+			}
+			if len(images) < 2 {
+				return
+			}
+			slow := images[1].(genericImage).WritableImage
+			b := fast.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if fast.At(x, y) != slow.At(x, y) {
+						t.Fatalf("pixel %d,%d differs: %v and %v", x, y, fast.At(x, y), slow.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForeignColorType(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	randv2.NewChaCha8([32]byte{3}).Read(data)
+	// the colors of these images convert to color.RGBA64 and back without loss
+	for _, kind := range []string{"rgba", "gray", "gray16"} {
+		im := testImage(kind, 100, 80, 1)
+		expected := referenceHiddenBytes(t, im, Layout{Bits: 2})
+		hidden, err := getHiddenBytes(ctx, rgba64Image{im}, Layout{Bits: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hidden, expected) {
+			t.Errorf("%s: hidden bytes differ from the reference", kind)
+		}
+		ibw, err := NewImageByteWriter(rgba64Image{im}, Layout{Bits: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ibw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected, data)
+		if !bytes.Equal(referenceHiddenBytes(t, im, Layout{Bits: 2}), expected) {
+			t.Errorf("%s: hidden bytes differ from the written data", kind)
+		}
+	}
+}
+
+func TestWriteHiddenBytesMatching(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range hiddenDataTests {
+		t.Run(test.String(), func(t *testing.T) {
+			if test.kind == "paletted" {
+				t.Skip("paletted images are never written with LSB matching, see TestEncodeTransparentPalette")
+			}
+			im := testImage(test.kind, test.w, test.h, 1)
+			original := testImage(test.kind, test.w, test.h, 1)
+			ibw, err := NewImageByteWriter(im, test.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ibw.bits.matching = true
+			data := make([]byte, ibw.Capacity())
+			randv2.NewChaCha8([32]byte{3}).Read(data)
+			if err = ibw.bits.writeBytes(ctx, data, 0); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(referenceHiddenBytes(t, im, test.layout), data) {
+				t.Error("hidden bytes differ from the written data")
+			}
+			// the highest hidden bit moves a value by its step, the lower hidden bits are replaced
+			orig, err := newImageBits(original, test.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			maxChange := 1<<test.layout.Bits - 1
+			for y := 0; y < ibw.bits.h; y++ {
+				for x := 0; x < ibw.bits.w; x++ {
+					for ch := 0; ch < ibw.bits.channels; ch++ {
+						v, o := int(ibw.bits.acc.get(x, y, ch)), int(orig.acc.get(x, y, ch))
+						if d := v - o; d > maxChange || d < -maxChange || v < ibw.bits.minValue(ch) && v != o {
+							t.Fatalf("value at %d,%d channel %d changed from %d to %d", x, y, ch, o, v)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPaletteOrder(t *testing.T) {
+	transparent := color.NRGBA{0, 0, 0, 0}
+	black := color.NRGBA{0, 0, 0, 0xff}
+	red := color.NRGBA{0xff, 0, 0, 0xff}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	halfRed := color.NRGBA{0xff, 0, 0, 0x80}
+	halfBlue := color.NRGBA{0, 0, 0xff, 0x80}
+	tests := []struct {
+		palette  color.Palette
+		pairs    [][2]color.Color
+		unpaired []color.Color
+	}{
+		{color.Palette{white, black}, [][2]color.Color{{black, white}}, nil},
+		// white is left out, since black and red are more similar than red and white
+		{color.Palette{transparent, black, red, white}, [][2]color.Color{{black, red}}, []color.Color{white, transparent}},
+		{color.Palette{white, halfRed, transparent, halfBlue, black}, [][2]color.Color{{black, white}, {halfBlue, halfRed}}, []color.Color{transparent}},
+	}
+	for _, test := range tests {
+		po := NewPaletteOrder(test.palette)
+		var ranked []color.Color
+		for rank, idx := range po.indexes {
+			if po.rank[idx] != rank {
+				t.Fatalf("%v: index %d has rank %d, expected %d", test.palette, idx, po.rank[idx], rank)
+			}
+			ranked = append(ranked, test.palette[idx])
+		}
+		var pairs [][2]color.Color
+		for rank := 0; rank < po.paired; rank += 2 {
+			pairs = append(pairs, [2]color.Color{ranked[rank], ranked[rank+1]})
+		}
+		if fmt.Sprint(pairs) != fmt.Sprint(test.pairs) || fmt.Sprint(ranked[po.paired:]) != fmt.Sprint(test.unpaired) {
+			t.Errorf("%v: got pairs %v and unpaired colors %v, expected %v and %v",
+				test.palette, pairs, ranked[po.paired:], test.pairs, test.unpaired)
+		}
+	}
+}
+
+// embedding into a palette with a transparent color must not make opaque pixels transparent or the other way around
+func TestEncodeTransparentPalette(t *testing.T) {
+	ctx := context.Background()
+	pal := color.Palette{color.NRGBA{0, 0, 0, 0}, color.NRGBA{0, 0, 0, 0xff}, color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0xff, 0xff, 0xff, 0xff}}
+	im := image.NewPaletted(image.Rect(0, 0, 64, 64), pal)
+	rng := randv2.New(randv2.NewPCG(5, 1))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(rng.IntN(len(pal)))
+	}
+	original := slices.Clone(im.Pix)
+	payload := make([]byte, 100)
+	randv2.NewChaCha8([32]byte{5}).Read(payload)
+	for _, matching := range []bool{false, true} {
+		copy(im.Pix, original)
+		out, err := Encode(ctx, im, bytes.NewReader(payload), Options{Matching: matching})
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := 0
+		for i, idx := range out.(*image.Paletted).Pix {
+			if idx == original[i] {
+				continue
+			}
+			changed++
+			_, _, _, a := pal[idx].RGBA()
+			_, _, _, b := pal[original[i]].RGBA()
+			if a != b {
+				t.Fatalf("matching %t: pixel %d changed from %v to %v", matching, i, pal[original[i]], pal[idx])
+			}
+		}
+		if changed == 0 {
+			t.Fatalf("matching %t: no pixel was changed", matching)
+		}
+		r, _, err := Decode(ctx, out, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payload) {
+			t.Errorf("matching %t: decoded data differs from the payload", matching)
+		}
+	}
+}
+
+func benchmarkImages(b *testing.B) map[string]WritableImage {
+	im := testImage("nrgba", 1024, 1024, 1)
+	return map[string]WritableImage{"pix": im, "at-set": genericImage{im}}
+}
+
+func BenchmarkReadHiddenBytes(b *testing.B) {
+	ctx := context.Background()
+	for name, im := range benchmarkImages(b) {
+		b.Run(name, func(b *testing.B) {
+			ibr, err := NewImageByteReader(im, Layout{Bits: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+			data := make([]byte, ibr.Size())
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				if err = ibr.bits.readBytes(ctx, data, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteHiddenBytes(b *testing.B) {
+	ctx := context.Background()
+	for name, im := range benchmarkImages(b) {
+		b.Run(name, func(b *testing.B) {
+			ibw, err := NewImageByteWriter(im, Layout{Bits: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+			data := make([]byte, ibw.Capacity())
+			randv2.NewChaCha8([32]byte{4}).Read(data)
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				if err = ibw.bits.writeBytes(ctx, data, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package steg
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+)
+
+// encrypted data has one key slot per recipient, all holding the same data key. to reveal as little as possible about
+// the recipients, the number of slots is rounded up to a power of two and all slots are as large as the largest key block,
+// unused slots and the space after smaller key blocks are filled with random data
+
+// keySlotCount returns the number of key slots used for the recipients
+func keySlotCount(recipients int) int {
+	slots := 1
+	for slots < recipients {
+		slots *= 2
+	}
+	return slots
+}
+
+// checkKeySlots checks the slot count and size read from a container header
+func checkKeySlots(slots int, slotSize int) error {
+	if slots < 1 || slots > maxKeySlots {
+		return fmt.Errorf("invalid number of key slots %d", slots)
+	}
+	if slotSize < passphraseBlockSize() || slotSize > maxRSAKeyBits/8 {
+		return fmt.Errorf("invalid key slot size %d", slotSize)
+	}
+	return nil
+}
+
+// recipientKeys checks the public keys the data is encrypted for and returns the number and size of the key slots
+// for them and the passphrase, no slots means the data is not encrypted
+func recipientKeys(opts *Options) ([]crypto.PublicKey, int, int, error) {
+	var keys []crypto.PublicKey
+	if opts.PublicKey != nil {
+		keys = append(keys, opts.PublicKey)
+	}
+	keys = append(keys, opts.Recipients...)
+	recipients := len(keys)
+	slotSize := 0
+	if len(opts.Passphrase) > 0 {
+		recipients++
+		slotSize = passphraseBlockSize()
+	}
+	if recipients == 0 {
+		return nil, 0, 0, nil
+	}
+	if recipients > maxKeySlots {
+		return nil, 0, 0, fmt.Errorf("too many recipients: %d, at most %d are supported", recipients, maxKeySlots)
+	}
+	for i, key := range keys {
+		var err error
+		if keys[i], _, err = publicKeyType(key); err != nil {
+			return nil, 0, 0, err
+		}
+		size, err := keyBlockSize(keys[i])
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		slotSize = max(slotSize, size)
+	}
+	return keys, keySlotCount(recipients), slotSize, nil
+}
+
+// fillKeySlots places the key blocks into randomly chosen slots
+func fillKeySlots(keyBlocks [][]byte, slots int, slotSize int) ([]byte, error) {
+	data := make([]byte, slots*slotSize)
+	if _, err := rand.Read(data); err != nil {
+		return nil, fmt.Errorf("failed to fill the key slots: %s", err.Error())
+	}
+	// the order of the slots does not matter, so it does not need a cryptographically secure shuffle
+	for i, slot := range mrand.Perm(slots)[:len(keyBlocks)] {
+		if len(keyBlocks[i]) > slotSize {
+			return nil, fmt.Errorf("key block is of size %d, larger than the slot size %d", len(keyBlocks[i]), slotSize)
+		}
+		copy(data[slot*slotSize:], keyBlocks[i])
+	}
+	return data, nil
+}
+
+// decryptKeySlots tries the private key and the passphrase of the options on every key slot until one can be decrypted
+// and opens the sealed tail with the data key it holds
+func decryptKeySlots(opts *Options, slots int, keyBlock []byte, sealedTail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	var errs []error
+	if opts.PrivateKey != nil {
+		info, err := decryptKeySlotsWithKey(opts.PrivateKey, opts, slots, keyBlock, sealedTail, aad)
+		if err == nil || !errors.Is(err, ErrWrongKey) {
+			return info, err
+		}
+		errs = append(errs, err)
+	}
+	if len(opts.Passphrase) > 0 {
+		info, err := decryptKeySlotsWithPassphrase(opts, slots, keyBlock, sealedTail, aad)
+		if err == nil || !errors.Is(err, ErrWrongKey) {
+			return info, err
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, ErrKeyRequired
+	}
+	return nil, errors.Join(errs...)
+}
+
+func decryptKeySlotsWithKey(priv crypto.PrivateKey, opts *Options, slots int, keyBlock []byte, sealedTail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	priv, keyType, err := privateKeyType(priv)
+	if err != nil {
+		return nil, err
+	}
+	// the key block of the private key is at the beginning of the slot
+	var blockSize int
+	switch key := priv.(type) {
+	case *rsa.PrivateKey:
+		blockSize = key.Size()
+	case *ecdh.PrivateKey:
+		blockSize = ecdhBlockSize(key.Curve())
+	}
+	slotSize := len(keyBlock) / slots
+	if blockSize > slotSize {
+		return nil, fmt.Errorf("%w: the key slots are too small for a %s key with %d bits", ErrWrongKey, keyType, blockSize*8)
+	}
+	for i := 0; i < slots; i++ {
+		opts.logf("trying key slot %d of %d", i+1, slots)
+		slot := keyBlock[i*slotSize : i*slotSize+blockSize]
+		info, err := decryptTail(priv, opts, keyType, slot, sealedTail, aad)
+		if errors.Is(err, ErrWrongKey) || errors.Is(err, ErrCorrupted) {
+			// the slot belongs to another recipient or is unused
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+	return nil, fmt.Errorf("%w: none of the %d key slots can be decrypted with the %s key", ErrWrongKey, slots, keyType)
+}
+
+func decryptKeySlotsWithPassphrase(opts *Options, slots int, keyBlock []byte, sealedTail []byte, aad []byte) (*EncryptedImageInformation, error) {
+	slotSize := len(keyBlock) / slots
+	blockSize := passphraseBlockSize()
+	for i := 0; i < slots; i++ {
+		opts.logf("trying the passphrase on key slot %d of %d", i+1, slots)
+		aesKey, err := unwrapKeyWithPassphrase(opts.Passphrase, keyBlock[i*slotSize:i*slotSize+blockSize], aad)
+		if errors.Is(err, ErrWrongKey) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		info, err := openTail(opts, aesKey, sealedTail, aad)
+		if err != nil {
+			return nil, err
+		}
+		info.keyType = KEY_PASSPHRASE
+		return info, nil
+	}
+	return nil, fmt.Errorf("%w: none of the %d key slots can be decrypted with the passphrase", ErrWrongKey, slots)
+}
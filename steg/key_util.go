@@ -0,0 +1,253 @@
+package steg
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// default size of generated RSA keys
+const RSA_KEY_BITS = 2048
+
+// PBKDF2 settings for passphrase protected private keys
+const pbkdf2Iterations = 600000
+const pbkdf2SaltSize = 16
+
+var (
+	// ErrPassphraseRequired is returned when loading a passphrase protected private key without a passphrase
+	ErrPassphraseRequired = errors.New("the private key is protected by a passphrase")
+	// ErrWrongPassphrase is returned if the passphrase cannot decrypt the private key
+	ErrWrongPassphrase = errors.New("wrong passphrase for the private key")
+)
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encrypted PKCS#8 structures as defined in RFC 5208 and RFC 8018, as written by "openssl pkcs8 -topk8 -v2 aes256"
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// GenerateRSAKey generates a RSA key pair that can be used with the -k flag
+func GenerateRSAKey(bits int) (*rsa.PrivateKey, error) {
+	if err := checkRSAKeySize(bits); err != nil {
+		return nil, err
+	}
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// GenerateKey generates a key pair of the given type, bits is only used for RSA keys
+func GenerateKey(keyType KeyType, bits int) (crypto.PrivateKey, crypto.PublicKey, error) {
+	switch keyType {
+	case KEY_RSA:
+		key, err := GenerateRSAKey(bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, key.Public(), nil
+	case KEY_X25519, KEY_P256:
+		key, err := keyType.curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, key.PublicKey(), nil
+	case KEY_PASSPHRASE:
+		return nil, nil, fmt.Errorf("%s is not a key pair", keyType)
+	}
+	return nil, nil, fmt.Errorf("unknown key type %d", byte(keyType))
+}
+
+func checkRSAKeySize(bits int) error {
+	if bits < minRSAKeyBits || bits > maxRSAKeyBits || bits%8 != 0 {
+		return fmt.Errorf("unsupported RSA key size %d, it must be a multiple of 8 between %d and %d bits", bits, minRSAKeyBits, maxRSAKeyBits)
+	}
+	return nil
+}
+
+// MarshalPrivateKeyPEM encodes the private key as PKCS#8 PEM, encrypted with the passphrase if it is not empty
+func MarshalPrivateKeyPEM(key crypto.PrivateKey, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal private key: %s", err.Error())
+	}
+	if len(passphrase) == 0 {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	if der, err = encryptPKCS8(der, passphrase); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// MarshalPublicKeyPEM encodes the public key as PKIX PEM
+func MarshalPublicKeyPEM(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %s", err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// Fingerprint returns the SHA256 hash of the PKIX encoded public key, which can be compared out of band
+func Fingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %s", err.Error())
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func encryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, pbkdf2SaltSize)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err.Error())
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate iv: %s", err.Error())
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %s", err.Error())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append([]byte{}, der...)
+	for i := 0; i < padding; i++ {
+		data = append(data, byte(padding))
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+}
+
+// decryptPKCS8 decrypts an encrypted PKCS#8 private key, only PBES2 with PBKDF2 and AES-CBC is supported
+func decryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted private key: %s", err.Error())
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse PBES2 parameters: %s", err.Error())
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, fmt.Errorf("failed to parse PBKDF2 parameters: %s", err.Error())
+	}
+	var prf func() hash.Hash
+	switch {
+	case kdfParams.PRF.Algorithm == nil, kdfParams.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 function %s", kdfParams.PRF.Algorithm)
+	}
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid private key cipher iv")
+	}
+	key, err := pbkdf2.Key(prf, string(passphrase), kdfParams.Salt, kdfParams.IterationCount, keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %s", err.Error())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted private key length %d", len(data))
+	}
+	data = append([]byte{}, data...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	// a wrong passphrase almost always results in invalid padding
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, ErrWrongPassphrase
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	return data[:len(data)-padding], nil
+}
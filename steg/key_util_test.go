@@ -0,0 +1,164 @@
+package steg
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the encrypted fixtures were written by openssl pkcs8 -topk8 -v2 <cipher> -v2prf <prf> from the key in pkcs8.pem
+const fixturePassphrase = "correct-horse"
+
+func readPEM(t *testing.T, name string) *pem.Block {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s holds no PEM data", name)
+	}
+	return block
+}
+
+// testKeyDER returns a PKCS#8 encoded X25519 key, which is 48 bytes long, so its padding is a whole block
+func testKeyDER(t *testing.T) []byte {
+	t.Helper()
+	priv, _, err := GenerateKey(KEY_X25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestEncryptPKCS8RoundTrip(t *testing.T) {
+	der := testKeyDER(t)
+	encrypted, err := encryptPKCS8(der, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := decryptPKCS8(encrypted, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, der) {
+		t.Error("decrypted key differs")
+	}
+	// a wrong passphrase fails the padding check, unless the padding happens to be valid
+	if decrypted, err = decryptPKCS8(encrypted, []byte("wrong")); err == nil && bytes.Equal(decrypted, der) {
+		t.Error("the wrong passphrase decrypted the key")
+	}
+
+	priv, pub, err := GenerateKey(KEY_P256, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalPrivateKeyPEM(priv, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadPrivateKeyWithPassphrase(path, nil); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("loading without passphrase: got %v", err)
+	}
+	loaded, err := LoadPrivateKeyWithPassphrase(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.(*ecdh.PrivateKey).PublicKey().Equal(pub) {
+		t.Error("loaded key differs")
+	}
+}
+
+func TestDecryptPKCS8OpenSSL(t *testing.T) {
+	plain := readPEM(t, "pkcs8.pem")
+	for _, name := range []string{"pkcs8_aes256.pem", "pkcs8_aes128_sha1.pem"} {
+		t.Run(name, func(t *testing.T) {
+			block := readPEM(t, name)
+			if block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("unexpected PEM type %s", block.Type)
+			}
+			der, err := decryptPKCS8(block.Bytes, []byte(fixturePassphrase))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(der, plain.Bytes) {
+				t.Error("decrypted key differs from pkcs8.pem")
+			}
+			if _, err = decryptPKCS8(block.Bytes, []byte("wrong passphrase")); !errors.Is(err, ErrWrongPassphrase) {
+				t.Errorf("wrong passphrase: got %v", err)
+			}
+			if _, err = LoadPrivateKeyWithPassphrase(filepath.Join("testdata", name), []byte(fixturePassphrase)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// withEncryptedData returns the encrypted key with its encrypted data changed by fn
+func withEncryptedData(t *testing.T, der []byte, fn func(data []byte) []byte) []byte {
+	t.Helper()
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		t.Fatal(err)
+	}
+	info.EncryptedData = fn(bytes.Clone(info.EncryptedData))
+	der, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestDecryptPKCS8Corrupted(t *testing.T) {
+	passphrase := []byte("passphrase")
+	encrypted, err := encryptPKCS8(testKeyDER(t), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		der  []byte
+		err  error
+	}{
+		// flipping a bit of the second to last block flips the same bit of the padding in the last block
+		{"padding length", withEncryptedData(t, encrypted, func(data []byte) []byte {
+			data[len(data)-17] ^= 0x20
+			return data
+		}), ErrWrongPassphrase},
+		{"padding bytes", withEncryptedData(t, encrypted, func(data []byte) []byte {
+			data[len(data)-18] ^= 0x01
+			return data
+		}), ErrWrongPassphrase},
+		{"partial block", withEncryptedData(t, encrypted, func(data []byte) []byte {
+			return data[:len(data)-5]
+		}), nil},
+		{"no data", withEncryptedData(t, encrypted, func(data []byte) []byte {
+			return nil
+		}), nil},
+		{"truncated", encrypted[:len(encrypted)/2], nil},
+		{"empty", nil, nil},
+	}
+	for _, test := range tests {
+		_, err := decryptPKCS8(test.der, passphrase)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
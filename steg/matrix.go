@@ -0,0 +1,115 @@
+package steg
+
+import (
+	"fmt"
+	"io"
+)
+
+// matrix embedding stores the data behind the header with a (1, 2^k-1, k) Hamming code: every group of 2^k-1 hidden bits
+// holds k data bits as its syndrome, the XOR of the (1 based) positions of the set bits in the group. writing a group
+// changes at most one of its bits, instead of half of the bits on average. k is chosen as large as the capacity allows
+// and stored in the last byte of the header, the header itself is stored as usual
+
+// largest supported number of data bits per group, the groups are then 65535 bits long
+const matrixMaxBits = 16
+
+// matrixGroupSize returns the number of hidden bits of a group holding k data bits
+func matrixGroupSize(k int) int {
+	return 1<<k - 1
+}
+
+// matrixCoverSize returns the number of hidden bytes needed to hold length bytes of data with k data bits per group
+func matrixCoverSize(length int, k int) int {
+	groups := (length*8 + k - 1) / k
+	return (groups*matrixGroupSize(k) + 7) / 8
+}
+
+// matrixCapacity returns the number of data bytes that fit into the hidden bytes with k data bits per group
+func matrixCapacity(cover int64, k int) int64 {
+	return cover * 8 / int64(matrixGroupSize(k)) * int64(k) / 8
+}
+
+// matrixBits chooses the number of data bits per group, the largest one that still fits the data into the hidden bytes
+func matrixBits(length int, cover int) (int, error) {
+	for k := matrixMaxBits; k > 0; k-- {
+		if matrixCoverSize(length, k) <= cover {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("%w. require %dB, but only have %dB", ErrCapacity, length, cover)
+}
+
+func getBit(data []byte, i int) int {
+	return int(data[i/8] >> (i % 8) & 1)
+}
+
+// syndrome returns the data bits held by the group of hidden bits starting at bit position start
+func syndrome(cover []byte, start int, k int) int {
+	s := 0
+	for i := 0; i < matrixGroupSize(k); i++ {
+		if getBit(cover, start+i) != 0 {
+			s ^= i + 1
+		}
+	}
+	return s
+}
+
+// matrixEmbed embeds the data into the hidden bytes of the cover, changing at most one bit per group
+func matrixEmbed(cover []byte, data []byte, k int) {
+	n := matrixGroupSize(k)
+	groups := (len(data)*8 + k - 1) / k
+	for g := 0; g < groups; g++ {
+		m := 0
+		for j := 0; j < k && g*k+j < len(data)*8; j++ {
+			m |= getBit(data, g*k+j) << j
+		}
+		if d := syndrome(cover, g*n, k) ^ m; d != 0 {
+			pos := g*n + d - 1
+			cover[pos/8] ^= 1 << (pos % 8)
+		}
+	}
+}
+
+// matrixData reads matrix embedded data from the hidden bytes behind the header
+type matrixData struct {
+	cover     io.ReaderAt
+	coverSize int64
+	k         int
+}
+
+func (md *matrixData) Size() int64 {
+	return matrixCapacity(md.coverSize, md.k)
+}
+
+func (md *matrixData) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	var err error
+	if available := md.Size() - off; available < int64(len(data)) {
+		data = data[:max(available, 0)]
+		err = io.EOF
+	}
+	if len(data) == 0 {
+		return 0, err
+	}
+	// read the groups holding the requested bits, Size makes sure that they are complete
+	k, n := md.k, int64(matrixGroupSize(md.k))
+	first, last := off*8/int64(k), ((off+int64(len(data)))*8-1)/int64(k)
+	from := first * n / 8
+	cover := make([]byte, ((last+1)*n+7)/8-from)
+	if _, err := md.cover.ReadAt(cover, from); err != nil {
+		return 0, err
+	}
+	clear(data)
+	for g := first; g <= last; g++ {
+		s := syndrome(cover, int(g*n-from*8), k)
+		for j := 0; j < k; j++ {
+			bit := g*int64(k) + int64(j) - off*8
+			if bit >= 0 && bit < int64(len(data))*8 && s>>j&1 != 0 {
+				data[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+	return len(data), err
+}
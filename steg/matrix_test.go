@@ -0,0 +1,138 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"image"
+	randv2 "math/rand/v2"
+	"testing"
+)
+
+// changedBits returns the number of bits that differ between a and b in the bit range [from, to)
+func changedBits(a, b []byte, from, to int) int {
+	n := 0
+	for i := from; i < to; i++ {
+		if getBit(a, i) != getBit(b, i) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMatrixEmbed(t *testing.T) {
+	rng := randv2.NewChaCha8([32]byte{7})
+	for k := 1; k <= matrixMaxBits; k++ {
+		data := make([]byte, 9)
+		rng.Read(data)
+		cover := make([]byte, matrixCoverSize(len(data), k))
+		rng.Read(cover)
+		embedded := bytes.Clone(cover)
+		matrixEmbed(embedded, data, k)
+		n := matrixGroupSize(k)
+		for g := 0; g*n+n <= len(cover)*8; g++ {
+			if changed := changedBits(cover, embedded, g*n, g*n+n); changed > 1 {
+				t.Fatalf("k %d: %d bits of group %d changed", k, changed, g)
+			}
+		}
+		md := &matrixData{cover: bytes.NewReader(embedded), coverSize: int64(len(embedded)), k: k}
+		read := make([]byte, len(data))
+		if _, err := md.ReadAt(read, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("k %d: read %x, embedded %x", k, read, data)
+		}
+		if _, err := md.ReadAt(read[:5], 3); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read[:5], data[3:8]) {
+			t.Errorf("k %d: read %x at offset 3, embedded %x", k, read[:5], data[3:8])
+		}
+	}
+}
+
+// matrixView returns the hidden bytes of the image in the order the data is written, for shuffled
+// and scattered data that is before shuffling or scattering
+func matrixView(t *testing.T, im image.Image, opts Options, key [32]byte) []byte {
+	t.Helper()
+	ctx := context.Background()
+	hidden, err := getHiddenBytes(ctx, im, opts.layout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ShuffleSeed == "" {
+		return hidden
+	}
+	if !opts.Scatter {
+		if err = unshuffleData(ctx, hidden, key); err != nil {
+			t.Fatal(err)
+		}
+		return hidden
+	}
+	ib, err := newImageBits(im, opts.layout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := newScatteredBits(ctx, ib, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sb.ReadAt(hidden, 0); err != nil {
+		t.Fatal(err)
+	}
+	return hidden
+}
+
+func TestEncodeMatrix(t *testing.T) {
+	header, err := newContainerHeader(Layout{Bits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.flags = flagHashed | flagMatrix
+	ibw, err := NewImageByteWriter(testImage("nrgba", 256, 256, 8), Layout{Bits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover := ibw.Capacity() - header.Size()
+	// the largest payload that is embedded with k data bits per group
+	lengths := make([]int, matrixMaxBits+1)
+	for length := 1; length <= cover; length++ {
+		if k, err := matrixBits(length, cover); err == nil {
+			lengths[k] = length
+		}
+	}
+	key, err := shuffleKey("seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []Options{{}, {ShuffleSeed: "seed"}, {ShuffleSeed: "seed", Scatter: true}}
+	for _, opts := range tests {
+		for k := 1; k <= matrixMaxBits; k++ {
+			if opts.ShuffleSeed != "" && k != 1 && k != matrixMaxBits {
+				// deriving the shuffle key takes a moment, so only the smallest and largest k are tested with a seed
+				continue
+			}
+			opts.Matrix = true
+			payload := make([]byte, lengths[k])
+			randv2.NewChaCha8([32]byte{byte(k)}).Read(payload)
+			original := testImage("nrgba", 256, 256, 8)
+			out, meta := encodeDecode(t, testImage("nrgba", 256, 256, 8), payload, opts)
+			if meta.MatrixBits != k {
+				t.Fatalf("seed %q scatter %t: %dB were embedded with %d bits per group instead of %d", opts.ShuffleSeed, opts.Scatter, len(payload), meta.MatrixBits, k)
+			}
+			// every group of the cover changes by at most one bit and nothing behind the groups changes
+			before, after := matrixView(t, original, opts, key), matrixView(t, out, opts, key)
+			n := matrixGroupSize(k)
+			start := header.Size() * 8
+			groups := (len(payload)*8 + k - 1) / k
+			for g := 0; g < groups; g++ {
+				if changed := changedBits(before, after, start+g*n, start+g*n+n); changed > 1 {
+					t.Fatalf("seed %q scatter %t k %d: %d bits of group %d changed", opts.ShuffleSeed, opts.Scatter, k, changed, g)
+				}
+			}
+			if changed := changedBits(before, after, start+groups*n, len(before)*8); changed > 0 {
+				t.Errorf("seed %q scatter %t k %d: %d bits behind the groups changed", opts.ShuffleSeed, opts.Scatter, k, changed)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package steg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt settings for passphrase key slots, they use 128 MiB of memory
+const scryptN = 1 << 17
+const scryptR = 8
+const scryptP = 1
+const scryptSaltSize = 16
+
+// a passphrase key slot holds the data key sealed with a key derived from the passphrase: [salt, sealed data key]
+func passphraseBlockSize() int {
+	return scryptSaltSize + dataKeySize + gcmTagSize
+}
+
+// passphraseKeyCipher derives the AES GCM cipher sealing the data key from the passphrase
+func passphraseKeyCipher(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the key from the passphrase: %s", err.Error())
+	}
+	cip, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	gcm, err := cipher.NewGCM(cip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %s", err.Error())
+	}
+	return gcm, nil
+}
+
+func wrapKeyWithPassphrase(passphrase []byte, aesKey []byte, aad []byte) ([]byte, error) {
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err.Error())
+	}
+	gcm, err := passphraseKeyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	// every slot has its own salt and therefore its own key, so a zero nonce is fine
+	nonce := make([]byte, gcm.NonceSize())
+	return gcm.Seal(salt, nonce, aesKey, aad), nil
+}
+
+func unwrapKeyWithPassphrase(passphrase []byte, keyBlock []byte, aad []byte) ([]byte, error) {
+	gcm, err := passphraseKeyCipher(passphrase, keyBlock[:scryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	aesKey, err := gcm.Open(nil, nonce, keyBlock[scryptSaltSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt the key block: %s", ErrWrongKey, err.Error())
+	}
+	return aesKey, nil
+}
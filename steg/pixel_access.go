@@ -0,0 +1,161 @@
+package steg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// channelAccess reads and writes single channel values of an image. x and y are relative to the
+// top left corner of the image bounds and the values are 8 or 16 bit wide depending on the image
+type channelAccess interface {
+	get(x, y, ch int) uint16
+	set(x, y, ch int, v uint16)
+}
+
+// newChannelAccess returns an accessor working directly on the Pix slice of the standard image types,
+// other images are accessed through At and Set, which is much slower. their color model must convert to
+// one of the colors of the standard image types
+func newChannelAccess(im image.Image) (channelAccess, error) {
+	switch i := im.(type) {
+	case *image.RGBA:
+		return &pixAccess8{pix: i.Pix, stride: i.Stride, step: 4}, nil
+	case *image.NRGBA:
+		return &pixAccess8{pix: i.Pix, stride: i.Stride, step: 4}, nil
+	case *image.Gray:
+		return &pixAccess8{pix: i.Pix, stride: i.Stride, step: 1}, nil
+	case *image.RGBA64:
+		return &pixAccess16{pix: i.Pix, stride: i.Stride, step: 8}, nil
+	case *image.NRGBA64:
+		return &pixAccess16{pix: i.Pix, stride: i.Stride, step: 8}, nil
+	case *image.Gray16:
+		return &pixAccess16{pix: i.Pix, stride: i.Stride, step: 2}, nil
+	case *image.Paletted:
+		return &paletteAccess{pix: i.Pix, stride: i.Stride, order: NewPaletteOrder(i.Palette)}, nil
+	default:
+		if !supportedColor(im.ColorModel().Convert(color.Black)) {
+			return nil, fmt.Errorf("unsupported color model of image type %T", im)
+		}
+		return &colorAccess{im: im, model: im.ColorModel(), min: im.Bounds().Min}, nil
+	}
+}
+
+// concurrentAccess reports whether different channel values can be safely written from multiple goroutines
+func concurrentAccess(acc channelAccess) bool {
+	_, generic := acc.(*colorAccess)
+	return !generic
+}
+
+type pixAccess8 struct {
+	pix    []uint8
+	stride int
+	step   int
+}
+
+func (a *pixAccess8) get(x, y, ch int) uint16 {
+	return uint16(a.pix[y*a.stride+x*a.step+ch])
+}
+
+func (a *pixAccess8) set(x, y, ch int, v uint16) {
+	a.pix[y*a.stride+x*a.step+ch] = uint8(v)
+}
+
+// 16 bit channels are stored big endian
+type pixAccess16 struct {
+	pix    []uint8
+	stride int
+	step   int
+}
+
+func (a *pixAccess16) get(x, y, ch int) uint16 {
+	i := y*a.stride + x*a.step + ch*2
+	return uint16(a.pix[i])<<8 | uint16(a.pix[i+1])
+}
+
+func (a *pixAccess16) set(x, y, ch int, v uint16) {
+	i := y*a.stride + x*a.step + ch*2
+	a.pix[i] = uint8(v >> 8)
+	a.pix[i+1] = uint8(v)
+}
+
+// the channel value of paletted images is the rank of the color index (see PaletteOrder)
+type paletteAccess struct {
+	pix    []uint8
+	stride int
+	order  *PaletteOrder
+}
+
+func (a *paletteAccess) get(x, y, ch int) uint16 {
+	return uint16(a.order.rank[a.pix[y*a.stride+x]])
+}
+
+func (a *paletteAccess) set(x, y, ch int, v uint16) {
+	a.pix[y*a.stride+x] = a.order.indexes[v]
+}
+
+// the colors returned by At are converted with the color model of the image, so they always have the type it was checked for
+type colorAccess struct {
+	im    image.Image
+	model color.Model
+	min   image.Point
+}
+
+func (a *colorAccess) get(x, y, ch int) uint16 {
+	return colorChannel(a.model.Convert(a.im.At(a.min.X+x, a.min.Y+y)), ch)
+}
+
+func (a *colorAccess) set(x, y, ch int, v uint16) {
+	x, y = a.min.X+x, a.min.Y+y
+	a.im.(WritableImage).Set(x, y, colorWithChannel(a.model.Convert(a.im.At(x, y)), ch, v))
+}
+
+// supportedColor reports whether colorChannel and colorWithChannel can handle the color
+func supportedColor(col color.Color) bool {
+	switch col.(type) {
+	case color.RGBA, color.NRGBA, color.RGBA64, color.NRGBA64, color.Gray, color.Gray16:
+		return true
+	}
+	return false
+}
+
+// colorChannel returns the value of the color channel at pos, 0 for unsupported colors (see supportedColor)
+func colorChannel(col color.Color, pos int) uint16 {
+	switch c := col.(type) {
+	case color.RGBA:
+		return uint16([4]uint8{c.R, c.G, c.B, c.A}[pos])
+	case color.NRGBA:
+		return uint16([4]uint8{c.R, c.G, c.B, c.A}[pos])
+	case color.RGBA64:
+		return [4]uint16{c.R, c.G, c.B, c.A}[pos]
+	case color.NRGBA64:
+		return [4]uint16{c.R, c.G, c.B, c.A}[pos]
+	case color.Gray:
+		return uint16(c.Y)
+	case color.Gray16:
+		return c.Y
+	}
+	return 0
+}
+
+// colorWithChannel returns the color with the channel at pos set to v, unsupported colors are returned unchanged
+func colorWithChannel(col color.Color, pos int, v uint16) color.Color {
+	switch c := col.(type) {
+	case color.RGBA:
+		*[4]*uint8{&c.R, &c.G, &c.B, &c.A}[pos] = uint8(v)
+		return c
+	case color.NRGBA:
+		*[4]*uint8{&c.R, &c.G, &c.B, &c.A}[pos] = uint8(v)
+		return c
+	case color.RGBA64:
+		*[4]*uint16{&c.R, &c.G, &c.B, &c.A}[pos] = v
+		return c
+	case color.NRGBA64:
+		*[4]*uint16{&c.R, &c.G, &c.B, &c.A}[pos] = v
+		return c
+	case color.Gray:
+		return color.Gray{Y: uint8(v)}
+	case color.Gray16:
+		return color.Gray16{Y: v}
+	}
+	return col
+}
@@ -0,0 +1,221 @@
+package steg
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+// scattering spreads the hidden bytes over the image like the shuffle does, but only touches the bits that hold data.
+// bit k of the hidden data is stored at position P(k) of the image, where P is a keyed permutation of all bit positions:
+// a balanced Feistel network with AES as round function, cycle walking until the result is a valid position.
+// the key is derived from the shuffle key, so the seed is the same as for shuffling
+const scatterHKDFInfo = "stuffer scatter key"
+
+// number of Feistel rounds of the permutation
+const scatterRounds = 4
+
+// the round functions are tables with an entry for every half of a position, this limits the number of bit positions to 2^48
+const scatterMaxHalf = 24
+
+// the bits are accessed in buckets of 2^scatterBucketBits consecutive bit positions instead of in the order of the data,
+// which keeps the image memory that is accessed in the CPU cache
+const scatterBucketBits = 12
+
+// bitPermutation is a keyed permutation of the bit positions [0, n)
+type bitPermutation struct {
+	rounds [scatterRounds][]uint32
+	n      uint64
+	half   uint
+	mask   uint64
+}
+
+func newBitPermutation(key [32]byte, n int) (*bitPermutation, error) {
+	scatterKey, err := hkdf.Key(sha256.New, key[:], nil, scatterHKDFInfo, 16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive the scatter key: %s", err.Error())
+	}
+	block, err := aes.NewCipher(scatterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher block: %s", err.Error())
+	}
+	// the domain of the Feistel network has an even number of bits and is less than 4 times as large as n,
+	// so cycle walking needs fewer than 4 tries on average
+	half := uint(max(1, (bits.Len64(uint64(n)-1)+1)/2))
+	if half > scatterMaxHalf {
+		return nil, fmt.Errorf("the image is too large to scatter the data: %d bit positions", n)
+	}
+	p := &bitPermutation{n: uint64(n), half: half, mask: 1<<half - 1}
+	for i := range p.rounds {
+		p.rounds[i] = roundTable(block, p.n, i, half)
+	}
+	return p, nil
+}
+
+// roundTable computes the round function of the Feistel network for every input, AES in counter mode with the
+// domain size and round in the nonce, so that images of different sizes use unrelated permutations
+func roundTable(block cipher.Block, n uint64, round int, half uint) []uint32 {
+	table := make([]uint32, max(1<<half, aes.BlockSize/4))
+	var in, out [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(in[:8], n<<8|uint64(round))
+	mask := uint32(1)<<half - 1
+	for i := 0; i < len(table); i += aes.BlockSize / 4 {
+		binary.BigEndian.PutUint64(in[8:], uint64(i))
+		block.Encrypt(out[:], in[:])
+		for j := 0; j < aes.BlockSize/4; j++ {
+			table[i+j] = binary.BigEndian.Uint32(out[j*4:]) & mask
+		}
+	}
+	return table[:1<<half]
+}
+
+// position returns the image bit position of hidden bit k, which must be lower than n
+func (p *bitPermutation) position(k uint64) uint64 {
+	for {
+		l, r := k>>p.half, k&p.mask
+		for i := 0; i < scatterRounds; i++ {
+			l, r = r, l^uint64(p.rounds[i][r])
+		}
+		k = l<<p.half | r
+		if k < p.n {
+			return k
+		}
+	}
+}
+
+// positions fills dst with the positions of the hidden bits starting at k, large amounts are computed in parallel
+func (p *bitPermutation) positions(ctx context.Context, dst []uint64, k uint64) error {
+	if len(dst) <= chunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i := range dst {
+			dst[i] = p.position(k + uint64(i))
+		}
+		return nil
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for from := range work {
+				to := min(from+chunkSize, len(dst))
+				for i := from; i < to; i++ {
+					dst[i] = p.position(k + uint64(i))
+				}
+			}
+		}()
+	}
+	var err error
+	for from := 0; from < len(dst); from += chunkSize {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		work <- from
+	}
+	close(work)
+	wg.Wait()
+	return err
+}
+
+// scatteredBits gives access to the hidden bytes of an image, scattered with the permutation.
+// it implements io.ReaderAt and io.WriterAt, reading and writing only the bits of the requested bytes
+type scatteredBits struct {
+	ctx  context.Context
+	ib   *imageBits
+	perm *bitPermutation
+}
+
+func newScatteredBits(ctx context.Context, ib *imageBits, key [32]byte) (*scatteredBits, error) {
+	perm, err := newBitPermutation(key, ib.bitCount())
+	if err != nil {
+		return nil, err
+	}
+	return &scatteredBits{ctx: ctx, ib: ib, perm: perm}, nil
+}
+
+// Size returns the number of hidden bytes the image can hold
+func (sb *scatteredBits) Size() int64 {
+	return int64(sb.ib.capacity())
+}
+
+// bitPositions returns the positions of the bits of n hidden bytes starting at byte offset off, fewer if the image is too small
+func (sb *scatteredBits) bitPositions(n int, off int64) ([]uint64, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("negative offset")
+	}
+	if available := sb.Size() - off; available < int64(n) {
+		n = int(max(available, 0))
+	}
+	if uint64(n)*8 > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("too much data to scatter: %d bytes", n)
+	}
+	positions := make([]uint64, n*8)
+	if err := sb.perm.positions(sb.ctx, positions, uint64(off)*8); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// bucketOrder returns the indexes of the positions sorted by their bucket
+func (sb *scatteredBits) bucketOrder(positions []uint64) []uint32 {
+	starts := make([]uint32, sb.perm.n>>scatterBucketBits+2)
+	for _, pos := range positions {
+		starts[pos>>scatterBucketBits+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	order := make([]uint32, len(positions))
+	for i, pos := range positions {
+		order[starts[pos>>scatterBucketBits]] = uint32(i)
+		starts[pos>>scatterBucketBits]++
+	}
+	return order
+}
+
+func (sb *scatteredBits) ReadAt(data []byte, off int64) (int, error) {
+	positions, err := sb.bitPositions(len(data), off)
+	if err != nil {
+		return 0, err
+	}
+	n := len(positions) / 8
+	clear(data[:n])
+	for _, i := range sb.bucketOrder(positions) {
+		c := sb.ib.cursor(int(positions[i]))
+		if c.bit() {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (sb *scatteredBits) WriteAt(data []byte, off int64) (int, error) {
+	positions, err := sb.bitPositions(len(data), off)
+	if err != nil {
+		return 0, err
+	}
+	n := len(positions) / 8
+	var flips coinFlips
+	for _, i := range sb.bucketOrder(positions) {
+		c := sb.ib.cursor(int(positions[i]))
+		c.setBit(data[i/8]&(1<<(i%8)) != 0, &flips)
+	}
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
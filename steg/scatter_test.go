@@ -0,0 +1,113 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+	randv2 "math/rand/v2"
+	"testing"
+)
+
+func TestBitPermutation(t *testing.T) {
+	var key [32]byte
+	key[0] = 1
+	for _, n := range []int{1, 2, 3, 5, 8, 100, 1000, 4096, 4097, 65535, 65536, 65537, 100003} {
+		p, err := newBitPermutation(key, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make([]bool, n)
+		for k := 0; k < n; k++ {
+			pos := p.position(uint64(k))
+			if pos >= uint64(n) {
+				t.Fatalf("n %d: bit %d is at position %d", n, k, pos)
+			}
+			if seen[pos] {
+				t.Fatalf("n %d: position %d is used twice", n, pos)
+			}
+			seen[pos] = true
+		}
+		positions := make([]uint64, n)
+		if err = p.positions(context.Background(), positions, 0); err != nil {
+			t.Fatal(err)
+		}
+		for k, pos := range positions {
+			if pos != p.position(uint64(k)) {
+				t.Fatalf("n %d: positions returned %d for bit %d instead of %d", n, pos, k, p.position(uint64(k)))
+			}
+		}
+	}
+}
+
+// encodeDecode embeds the payload into im and checks that it decodes again, it returns the image holding the data
+func encodeDecode(t *testing.T, im image.Image, payload []byte, opts Options) (image.Image, Metadata) {
+	t.Helper()
+	ctx := context.Background()
+	out, err := Encode(ctx, im, bytes.NewReader(payload), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, meta, err := Decode(ctx, out, Options{ShuffleSeed: opts.ShuffleSeed, PrivateKey: opts.PrivateKey, Passphrase: opts.Passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatal("decoded data differs from the payload")
+	}
+	return out, meta
+}
+
+func TestEncodeScatter(t *testing.T) {
+	ctx := context.Background()
+	payload := make([]byte, 1000)
+	randv2.NewChaCha8([32]byte{6}).Read(payload)
+	for _, layout := range []Layout{{Bits: 1}, {Bits: 2, Alpha: true}} {
+		original := testImage("nrgba", 200, 150, 6).(*image.NRGBA)
+		opts := Options{ShuffleSeed: "seed", Scatter: true, Bits: layout.Bits, Alpha: layout.Alpha}
+		encoded, _ := encodeDecode(t, testImage("nrgba", 200, 150, 6), payload, opts)
+		out := encoded.(*image.NRGBA)
+
+		// only the bits holding the header and data may differ from the original image
+		_, header, err := findContainer(ctx, out, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := shuffleKey(opts.ShuffleSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, err := newImageBits(out, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := newScatteredBits(ctx, written, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used, err := sb.bitPositions(header.Size()+int(header.length), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &image.NRGBA{Pix: bytes.Clone(original.Pix), Stride: original.Stride, Rect: original.Rect}
+		ib, err := newImageBits(expected, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var flips coinFlips
+		for _, pos := range used {
+			c, w := ib.cursor(int(pos)), written.cursor(int(pos))
+			c.setBit(w.bit(), &flips)
+		}
+		if !bytes.Equal(out.Pix, expected.Pix) {
+			t.Errorf("%s: bits outside of the header and data were changed", layout)
+		}
+		if bytes.Equal(out.Pix, original.Pix) {
+			t.Errorf("%s: the image was not changed", layout)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package steg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	randv2 "math/rand/v2"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// the shuffle permutes all of the hidden bytes of the image, the container header included. since the decoder cannot tell
+// which algorithm was used before unshuffling, it tries all of them (see hiddenDataSources).
+// the keyed shuffle is a Fisher-Yates shuffle driven by ChaCha8, keyed with a scrypt hash of the seed so that guessing
+// the seed is slow. the shuffle itself is implemented here instead of using rand.Shuffle, so it cannot change with Go releases
+const shuffleKeySalt = "stuffer shuffle key"
+
+// how often the shuffle checks whether the context was cancelled
+const shuffleCheckInterval = 1 << 20
+
+// shuffleKey derives the ChaCha8 key of the keyed shuffle from the seed
+func shuffleKey(shuffleSeed string) ([32]byte, error) {
+	var key [32]byte
+	derived, err := scrypt.Key([]byte(shuffleSeed), []byte(shuffleKeySalt), scryptN, scryptR, scryptP, len(key))
+	if err != nil {
+		return key, fmt.Errorf("failed to derive the shuffle key: %s", err.Error())
+	}
+	copy(key[:], derived)
+	return key, nil
+}
+
+// shuffleSwaps returns the swap partners of the Fisher-Yates shuffle of n bytes, byte i is swapped with swaps[i]
+// going from the last byte down to the second
+func shuffleSwaps(ctx context.Context, key [32]byte, n int) ([]uint32, error) {
+	if uint64(n) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("too much data to shuffle: %d bytes", n)
+	}
+	src := randv2.NewChaCha8(key)
+	swaps := make([]uint32, n)
+	for i := n - 1; i > 0; i-- {
+		if i%shuffleCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		swaps[i] = uint32(boundedRandom(src, uint64(i)+1))
+	}
+	return swaps, nil
+}
+
+// boundedRandom returns an unbiased random number in [0, n) using Lemire's multiply and reject method
+func boundedRandom(src *randv2.ChaCha8, n uint64) uint64 {
+	hi, lo := bits.Mul64(src.Uint64(), n)
+	if lo < n {
+		threshold := -n % n
+		for lo < threshold {
+			hi, lo = bits.Mul64(src.Uint64(), n)
+		}
+	}
+	return hi
+}
+
+// shuffleData permutes the data in place with the keyed shuffle
+func shuffleData(ctx context.Context, data []byte, key [32]byte) error {
+	swaps, err := shuffleSwaps(ctx, key, len(data))
+	if err != nil {
+		return err
+	}
+	for i := len(data) - 1; i > 0; i-- {
+		j := swaps[i]
+		data[i], data[j] = data[j], data[i]
+	}
+	return nil
+}
+
+// shufflePositions returns the positions of the first count bytes of the data in the data shuffled by shuffleData,
+// without shuffling anything. it follows those bytes through the swaps of the shuffle
+func shufflePositions(ctx context.Context, key [32]byte, n int, count int) ([]int, error) {
+	if uint64(n) > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("too much data to shuffle: %d bytes", n)
+	}
+	count = min(count, n)
+	// the bytes that are followed, by their current position. most swaps do not touch them, which the bit set tells quickly
+	at := make(map[int]int, count)
+	tracked := make([]uint64, (n+63)/64)
+	for k := 0; k < count; k++ {
+		at[k] = k
+		tracked[k/64] |= 1 << (k % 64)
+	}
+	src := randv2.NewChaCha8(key)
+	for i := n - 1; i > 0; i-- {
+		if i%shuffleCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		j := int(boundedRandom(src, uint64(i)+1))
+		ti, tj := tracked[i/64]&(1<<(i%64)) != 0, tracked[j/64]&(1<<(j%64)) != 0
+		if i == j || !ti && !tj {
+			continue
+		}
+		ki, kj := at[i], at[j]
+		delete(at, i)
+		delete(at, j)
+		tracked[i/64] &^= 1 << (i % 64)
+		tracked[j/64] &^= 1 << (j % 64)
+		if ti {
+			at[j] = ki
+			tracked[j/64] |= 1 << (j % 64)
+		}
+		if tj {
+			at[i] = kj
+			tracked[i/64] |= 1 << (i % 64)
+		}
+	}
+	positions := make([]int, count)
+	for pos, k := range at {
+		positions[k] = pos
+	}
+	return positions, nil
+}
+
+// unshuffleData reverts the permutation done by shuffleData with the same key
+func unshuffleData(ctx context.Context, data []byte, key [32]byte) error {
+	swaps, err := shuffleSwaps(ctx, key, len(data))
+	if err != nil {
+		return err
+	}
+	for i := 1; i < len(data); i++ {
+		j := swaps[i]
+		data[i], data[j] = data[j], data[i]
+	}
+	return nil
+}
+
+// legacyUnshuffleData reverts the shuffle of older versions, which applied rand.Shuffle four times with math/rand sources
+// seeded from the SHA256 hash of the seed. it is only kept for decoding existing images and must not be changed
+func legacyUnshuffleData(ctx context.Context, data []byte, shuffleSeed string) error {
+	indexes, err := legacyShuffleIndexes(ctx, len(data), shuffleSeed)
+	if err != nil {
+		return err
+	}
+	for newidx, oldidx := range indexes {
+		for newidx != oldidx {
+			data[newidx], data[oldidx] = data[oldidx], data[newidx]
+			indexes[newidx], indexes[oldidx] = indexes[oldidx], indexes[newidx]
+			oldidx = indexes[newidx]
+		}
+	}
+	return nil
+}
+
+// legacyShuffleIndexes returns the permutation of the legacy shuffle for data of n bytes,
+// the byte at position pos of the shuffled data is byte indexes[pos] of the data
+func legacyShuffleIndexes(ctx context.Context, n int, shuffleSeed string) ([]int, error) {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	passwordHash := sha256.Sum256([]byte(shuffleSeed))
+	for i := 0; i < 4; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		seed := int64(binary.BigEndian.Uint64(passwordHash[(i * 8) : (i*8)+8]))
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(indexes), func(i, j int) {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		})
+	}
+	return indexes, nil
+}
+
+// hiddenDataSources returns the ways the hidden data may have been spread over the image with the seed of the options,
+// in the order they should be tried. without a seed the data is neither shuffled nor scattered
+func hiddenDataSources(opts *Options) ([]hiddenDataSource, error) {
+	if opts.ShuffleSeed == "" {
+		return []hiddenDataSource{plainSource}, nil
+	}
+	key, err := shuffleKey(opts.ShuffleSeed)
+	if err != nil {
+		return nil, err
+	}
+	keyed := shuffleAlgorithm{
+		positions: func(ctx context.Context, n int, count int) ([]int, error) {
+			return shufflePositions(ctx, key, n, count)
+		},
+		unshuffle: func(ctx context.Context, data []byte) error {
+			opts.logf("unshuffling data")
+			return unshuffleData(ctx, data, key)
+		},
+	}
+	legacy := shuffleAlgorithm{
+		positions: func(ctx context.Context, n int, count int) ([]int, error) {
+			indexes, err := legacyShuffleIndexes(ctx, n, opts.ShuffleSeed)
+			if err != nil {
+				return nil, err
+			}
+			positions := make([]int, min(count, n))
+			for pos, k := range indexes {
+				if k < len(positions) {
+					positions[k] = pos
+				}
+			}
+			return positions, nil
+		},
+		unshuffle: func(ctx context.Context, data []byte) error {
+			opts.logf("unshuffling data with the legacy shuffle")
+			return legacyUnshuffleData(ctx, data, opts.ShuffleSeed)
+		},
+		// images shuffled with the legacy shuffle were all written before the layout could be chosen
+		layouts: []Layout{{Bits: 1}},
+	}
+	// gathering the header of scattered data is cheap, so it is tried first
+	return []hiddenDataSource{scatteredSource(key), shuffledSource(keyed), shuffledSource(legacy)}, nil
+}
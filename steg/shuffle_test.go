@@ -0,0 +1,57 @@
+package steg
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestShufflePositions(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var key [32]byte
+	key[3] = 9
+	shuffled := bytes.Clone(data)
+	if err := shuffleData(ctx, shuffled, key); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := shufflePositions(ctx, key, len(data), 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, pos := range positions {
+		if shuffled[pos] != data[k] {
+			t.Fatalf("byte %d is not at position %d", k, pos)
+		}
+	}
+	if err = unshuffleData(ctx, shuffled, key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(shuffled, data) {
+		t.Fatal("unshuffled data differs")
+	}
+}
+
+func TestLegacyShuffleIndexes(t *testing.T) {
+	ctx := context.Background()
+	shuffled := make([]byte, 5000)
+	for i := range shuffled {
+		shuffled[i] = byte(i * 7)
+	}
+	indexes, err := legacyShuffleIndexes(ctx, len(shuffled), "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Clone(shuffled)
+	if err = legacyUnshuffleData(ctx, data, "seed"); err != nil {
+		t.Fatal(err)
+	}
+	for pos, k := range indexes {
+		if data[k] != shuffled[pos] {
+			t.Fatalf("byte %d is not at position %d", k, pos)
+		}
+	}
+}
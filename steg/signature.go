@@ -0,0 +1,168 @@
+package steg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// signed data starts with a signature block in front of the (compressed) data, it is encrypted together with the data:
+// [algorithm, signature length, signature]. the signature covers the hash, timestamp and extension of the tail,
+// so it only makes sense for encrypted and hashed data
+const signatureContext = "stuffer data signature"
+
+// signature algorithms of the signature block
+const (
+	sigEd25519 byte = iota + 1
+	sigRSAPSS
+)
+
+// size of the algorithm and length fields of the signature block
+const signatureFieldsLen = 3
+
+// LoadSigningKey loads an Ed25519 or RSA private key for signing the data, it may be protected by a passphrase
+func LoadSigningKey(keyPath string, passphrase []byte) (crypto.PrivateKey, error) {
+	privateKey, err := readPrivateKey(keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = signatureAlgorithm(privateKey); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// LoadVerifyKey loads the Ed25519 or RSA public key of the sender, see Options.VerifyKey
+func LoadVerifyKey(keyPath string) (crypto.PublicKey, error) {
+	publicKey, err := readPublicKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = signatureAlgorithm(publicKey); err != nil {
+		return nil, err
+	}
+	return publicKey, nil
+}
+
+// GenerateSigningKey generates an Ed25519 key pair that can be used with Options.SigningKey and Options.VerifyKey
+func GenerateSigningKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pub, nil
+}
+
+// signatureAlgorithm returns the signature algorithm of a signing or verification key
+func signatureAlgorithm(key any) (byte, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return sigEd25519, nil
+	case *rsa.PrivateKey:
+		return sigRSAPSS, checkRSAKeySize(k.Size() * 8)
+	case *rsa.PublicKey:
+		return sigRSAPSS, checkRSAKeySize(k.Size() * 8)
+	}
+	return 0, fmt.Errorf("unsupported signature key type %T, only Ed25519 and RSA keys can sign", key)
+}
+
+func signatureAlgorithmName(algorithm byte) string {
+	switch algorithm {
+	case sigEd25519:
+		return "Ed25519"
+	case sigRSAPSS:
+		return "RSA-PSS"
+	}
+	return fmt.Sprintf("unknown signature algorithm %d", algorithm)
+}
+
+// signatureMessage returns the signed message, the timestamp and extension are encoded as in the tail
+func signatureMessage(hash []byte, timestamp int64, extension string) []byte {
+	var extensionBytes [extensionLen]byte
+	copy(extensionBytes[:], extension)
+	message := append([]byte(signatureContext), 0)
+	message = append(message, hash...)
+	message = binary.BigEndian.AppendUint64(message, uint64(timestamp))
+	return append(message, extensionBytes[:]...)
+}
+
+// signData returns the signature block of the message
+func signData(priv crypto.PrivateKey, message []byte) ([]byte, error) {
+	algorithm, err := signatureAlgorithm(priv)
+	if err != nil {
+		return nil, err
+	}
+	var signature []byte
+	switch key := priv.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, message)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign the data: %s", err.Error())
+		}
+	}
+	block := []byte{algorithm}
+	block = binary.BigEndian.AppendUint16(block, uint16(len(signature)))
+	return append(block, signature...), nil
+}
+
+// splitSignature splits the signature block off the decrypted data
+func splitSignature(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < signatureFieldsLen {
+		return 0, nil, nil, fmt.Errorf("%w: signature block is truncated", ErrCorrupted)
+	}
+	length := int(binary.BigEndian.Uint16(data[1:signatureFieldsLen]))
+	if len(data) < signatureFieldsLen+length {
+		return 0, nil, nil, fmt.Errorf("%w: signature block is truncated", ErrCorrupted)
+	}
+	return data[0], data[signatureFieldsLen : signatureFieldsLen+length], data[signatureFieldsLen+length:], nil
+}
+
+// verifySignature checks the signature of the message with the public key of the sender
+func verifySignature(pub crypto.PublicKey, algorithm byte, signature []byte, message []byte) error {
+	expected, err := signatureAlgorithm(pub)
+	if err != nil {
+		return err
+	}
+	if algorithm != expected {
+		return fmt.Errorf("%w: the data is signed with %s, but the key is a %s key", ErrSignature, signatureAlgorithmName(algorithm), signatureAlgorithmName(expected))
+	}
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, message, signature) {
+			return fmt.Errorf("%w: Ed25519 verification failed", ErrSignature)
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if err = rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return fmt.Errorf("%w: RSA-PSS verification failed: %s", ErrSignature, err.Error())
+		}
+	}
+	return nil
+}
+
+// checkSignature splits the signature block off the decrypted data and verifies it if the options have the key of the sender
+func (info *EncryptedImageInformation) checkSignature(opts *Options, data []byte) ([]byte, error) {
+	algorithm, signature, rest, err := splitSignature(data)
+	if err != nil {
+		return nil, err
+	}
+	info.signature = signatureAlgorithmName(algorithm)
+	if opts.VerifyKey == nil {
+		opts.logf("the data is signed with %s, but no key was given to verify it", info.signature)
+		return rest, nil
+	}
+	opts.logf("verifying %s signature", info.signature)
+	message := signatureMessage(info.hash, info.timestamp.Unix(), info.extension)
+	if err = verifySignature(opts.VerifyKey, algorithm, signature, message); err != nil {
+		return nil, err
+	}
+	info.signatureVerified = true
+	return rest, nil
+}
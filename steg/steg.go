@@ -0,0 +1,166 @@
+// Package steg embeds data into the least significant bits of images and extracts it again.
+//
+// The hidden data starts with a container header describing how it was written, so Decode only
+// needs the secrets that were used by Encode (the shuffle seed and the private key), everything else
+// is detected. Images written before the header was introduced are decoded using the legacy layout.
+package steg
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrCapacity is returned by Encode if the data does not fit into the image
+	ErrCapacity = errors.New("image capacity is too small")
+	// ErrHashMismatch is returned when the extracted data does not match the hash stored with it
+	ErrHashMismatch = errors.New("data hash verification failed")
+	// ErrWrongKey is returned if the private key or passphrase cannot decrypt the hidden data
+	ErrWrongKey = errors.New("wrong private key or passphrase")
+	// ErrKeyRequired is returned by Decode if the hidden data is encrypted, but neither a private key nor a passphrase was given
+	ErrKeyRequired = errors.New("the hidden data is encrypted, the private key or passphrase is required to decode it")
+	// ErrLegacyRSA is returned if the hidden data was encrypted with RSA PKCS#1 v1.5 padding, but Options.LegacyRSA is not set
+	ErrLegacyRSA = errors.New("the hidden data is encrypted with the legacy RSA PKCS#1 v1.5 padding, which has to be allowed explicitly")
+	// ErrSignature is returned by Decode if Options.VerifyKey is set, but the data is not signed with the matching private key
+	ErrSignature = errors.New("the hidden data is not signed by the expected sender")
+	// ErrCorrupted is returned if the hidden data is damaged, e.g. its length exceeds the capacity of the image
+	ErrCorrupted = errors.New("the hidden data is corrupted")
+	// ErrNoData is returned by Decode if neither a container header nor valid legacy data was found
+	ErrNoData = errors.New("no hidden data found")
+	// ErrUnsupportedImage is returned for images that cannot hold hidden data in the requested layout
+	ErrUnsupportedImage = errors.New("unsupported image")
+)
+
+// Options configures Encode and Decode. the zero value embeds hashed data into the least significant bit
+// of every color channel
+type Options struct {
+	// Bits is the number of least significant bits of each channel used for the data (1-MAX_BITS), 0 means 1.
+	// only used by Encode, Decode detects the layout
+	Bits int
+	// Alpha also uses the alpha channel of NRGBA images, fully transparent pixels are skipped
+	Alpha bool
+	// NoHash skips hashing the data. Decode only uses it for images in the legacy layout,
+	// which cannot tell whether they were hashed
+	NoHash bool
+	// Compress compresses the data before embedding it
+	Compress bool
+	// ShuffleSeed spreads the data over the whole image, Decode requires the same seed
+	ShuffleSeed string
+	// Scatter spreads the data over the image with the shuffle seed like shuffling does, but only changes the bits
+	// holding the data instead of rewriting the whole image. only used by Encode, Decode detects it
+	Scatter bool
+	// Fill overwrites the hidden bytes behind the data with noise, so the end of the data is not visible.
+	// the header of unencrypted data still holds the length, which only ShuffleSeed hides. it cannot be combined
+	// with Scatter, which only changes the bits holding the data. only used by Encode
+	Fill FillMode
+	// Matching changes a channel value by one up or down at random when its bit has to change, instead of replacing
+	// the bit (LSB matching). the data reads back the same, but is harder to detect. with more than one bit per channel
+	// only the highest bit is matched. only used by Encode
+	Matching bool
+	// Matrix stores the data with matrix embedding, which changes far fewer bits for data that is small compared
+	// to the capacity (see matrix.go). only used by Encode, Decode detects it
+	Matrix bool
+	// PublicKey encrypts the data for the owner of the matching private key, it is a *rsa.PublicKey
+	// or a *ecdh.PublicKey (X25519 or P-256). ECDSA P-256 keys are accepted as well
+	PublicKey crypto.PublicKey
+	// Recipients are further public keys the data is encrypted for, each of the matching private keys can decrypt it.
+	// the number of recipients is rounded up to a power of two with unused key slots, at most 16 are supported
+	Recipients []crypto.PublicKey
+	// PrivateKey decrypts encrypted data, the key types match PublicKey
+	PrivateKey crypto.PrivateKey
+	// Passphrase encrypts the data so that it can be decrypted with the same passphrase, alone or in addition
+	// to the public keys. the key is derived from the passphrase with scrypt, which takes a moment on purpose
+	Passphrase []byte
+	// LegacyRSA allows decrypting images in the legacy layout, which wrap the key with
+	// RSA PKCS#1 v1.5 padding instead of RSA-OAEP. PKCS#1 v1.5 decryption is prone to padding oracle attacks,
+	// so only enable it for images from trusted sources
+	LegacyRSA bool
+	// SigningKey signs the hash, timestamp and extension of encrypted data, it is an ed25519.PrivateKey
+	// or a *rsa.PrivateKey (RSA-PSS). the data must be hashed
+	SigningKey crypto.PrivateKey
+	// VerifyKey makes Decode reject data that is not signed by the matching private key, the key types match SigningKey
+	VerifyKey crypto.PublicKey
+	// Extension of the data file, it is stored with encrypted data
+	Extension string
+	// Log receives progress messages, one per line, if set
+	Log io.Writer
+}
+
+func (opts *Options) layout() Layout {
+	if opts.Bits == 0 {
+		return Layout{Bits: 1, Alpha: opts.Alpha}
+	}
+	return Layout{Bits: opts.Bits, Alpha: opts.Alpha}
+}
+
+func (opts *Options) logf(format string, args ...any) {
+	if opts.Log != nil {
+		fmt.Fprintf(opts.Log, format+"\n", args...)
+	}
+}
+
+// Metadata describes the hidden data found by Decode
+type Metadata struct {
+	// Version of the container format, 0 for images in the legacy layout
+	Version    int
+	Layout     Layout
+	Hashed     bool
+	Encrypted  bool
+	Compressed bool
+	// Length of the data as stored in the image, after compression and encryption
+	Length uint32
+	// Hash is the SHA256 hash of the original data, if it was hashed
+	Hash []byte
+	// KeyType and KeyBits describe the key the data was encrypted for, they are only known
+	// once the data was decrypted
+	KeyType KeyType
+	KeyBits int
+	// KeySlots is the number of recipients rounded up to a power of two, 0 for images in the legacy layout
+	KeySlots int
+	// LegacyRSA is set if the encrypted data uses RSA PKCS#1 v1.5 padding, see Options.LegacyRSA
+	LegacyRSA bool
+	// Signed is set if the data carries a signature of its sender, SignatureVerified once Decode checked it
+	// against Options.VerifyKey. Signature is the signature algorithm, it is only known after decrypting the data
+	Signed            bool
+	SignatureVerified bool
+	Signature         string
+	// MatrixBits is the number of data bits per group of matrix embedded data, 0 without matrix embedding
+	MatrixBits int
+	// Extension and Timestamp are only stored with encrypted data
+	Extension string
+	Timestamp time.Time
+	// Nonce of the AES GCM encryption, it is random for every encoded image and only known once the data was decrypted
+	Nonce []byte
+}
+
+func (h *ContainerHeader) metadata() Metadata {
+	return Metadata{
+		Version:    int(h.version),
+		Layout:     h.layout,
+		Hashed:     h.hashed(),
+		Encrypted:  h.encrypted(),
+		Compressed: h.compressed(),
+		Length:     h.length,
+		Hash:       h.hash,
+		KeyType:    h.keyType,
+		KeyBits:    h.keyBits(),
+		KeySlots:   h.slots,
+		LegacyRSA:  h.encrypted() && h.legacyPadding(),
+		Signed:     h.signed(),
+		MatrixBits: h.matrixBits,
+	}
+}
+
+// keyBits returns the size of the key the data was encrypted for, 0 if it is not encrypted
+func (h *ContainerHeader) keyBits() int {
+	switch h.keyType {
+	case KEY_RSA:
+		return h.blockSize * 8
+	case KEY_X25519, KEY_P256:
+		return 256
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"stuffer/steg"
+)
+
+// exit codes of the verify command
+const (
+	VERIFY_MATCH       = 0
+	VERIFY_MISMATCH    = 1
+	VERIFY_NO_HASH     = 2
+	VERIFY_UNDECODABLE = 3
+	VERIFY_ERROR       = 4
+)
+
+// exitError makes the program exit with a specific code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keyFile := fs.String("k", "", "private key file, required for encrypted data")
+	keyPassFile := fs.String("kp", "", "file containing the passphrase of the private key, if it is protected by one")
+	shuffleSeed := fs.String("ss", "", "shuffle seed, required if the data was shuffled")
+	noHash := fs.Bool("nh", false, "the data is not hashed. only required for images in the legacy layout")
+	passphrase := fs.String("p", "", "passphrase the data was encrypted with")
+	passFile := fs.String("pass-file", "", "file containing the passphrase the data was encrypted with")
+	legacyRSA := fs.Bool("legacy-rsa", false, "allow decrypting data that uses RSA PKCS#1 v1.5 padding, written by older versions of stuffer without a container header")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [flags] <image> <file>\n", programName())
+		fmt.Fprintln(os.Stderr, "checks whether the hidden data matches the file, without writing the data anywhere")
+		fmt.Fprintf(os.Stderr, "exit codes: %d match, %d mismatch, %d the data has no hash, %d the image cannot be decoded, %d other errors\n",
+			VERIFY_MATCH, VERIFY_MISMATCH, VERIFY_NO_HASH, VERIFY_UNDECODABLE, VERIFY_ERROR)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		// -h must not exit with the match code
+		return &exitError{VERIFY_ERROR, err}
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return &exitError{VERIFY_ERROR, fmt.Errorf("expected 2 required positional arguments <image> <file>. arguments got: %d", fs.NArg())}
+	}
+
+	opts := steg.Options{ShuffleSeed: *shuffleSeed, NoHash: *noHash, LegacyRSA: *legacyRSA}
+	var err error
+	if *keyFile != "" {
+		if opts.PrivateKey, err = loadPrivateKey(*keyFile, *keyPassFile); err != nil {
+			return &exitError{VERIFY_ERROR, err}
+		}
+	}
+	if opts.Passphrase, err = dataPassphrase(*passphrase, *passFile); err != nil {
+		return &exitError{VERIFY_ERROR, err}
+	}
+	fData, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return &exitError{VERIFY_ERROR, err}
+	}
+	defer fData.Close()
+	hasher := sha256.New()
+	fileSize, err := io.Copy(hasher, fData)
+	if err != nil {
+		return &exitError{VERIFY_ERROR, fmt.Errorf("failed to read the file: %s", err.Error())}
+	}
+
+	im, _, err := loadImage(fs.Arg(0))
+	if err != nil {
+		return &exitError{VERIFY_UNDECODABLE, err}
+	}
+	payload, meta, err := steg.Decode(ctx, im, opts)
+	if errors.Is(err, steg.ErrLegacyRSA) {
+		return &exitError{VERIFY_UNDECODABLE, fmt.Errorf("%s (-legacy-rsa)", err.Error())}
+	} else if errors.Is(err, steg.ErrKeyRequired) {
+		return &exitError{VERIFY_UNDECODABLE, fmt.Errorf("%s (-k, -p or -pass-file)", err.Error())}
+	} else if err != nil {
+		return &exitError{VERIFY_UNDECODABLE, err}
+	}
+	if !meta.Hashed {
+		return &exitError{VERIFY_NO_HASH, fmt.Errorf("the hidden data has no hash, it was embedded with -nh")}
+	}
+	if !bytes.Equal(hasher.Sum(nil), meta.Hash) {
+		return &exitError{VERIFY_MISMATCH, fmt.Errorf("mismatch: the hidden data has hash %x, the file %x", meta.Hash, hasher.Sum(nil))}
+	}
+	// the stored hash alone does not show that the data in the image is still intact,
+	// the decoded data is checked against it at the end
+	size, err := io.Copy(io.Discard, payload)
+	if errors.Is(err, steg.ErrHashMismatch) {
+		return &exitError{VERIFY_MISMATCH, fmt.Errorf("mismatch: the hidden data was modified, it does not match its hash")}
+	} else if err != nil {
+		return &exitError{VERIFY_UNDECODABLE, fmt.Errorf("failed to read the hidden data: %s", err.Error())}
+	}
+	if size != fileSize {
+		return &exitError{VERIFY_MISMATCH, fmt.Errorf("mismatch: the hidden data has %d bytes, the file %d", size, fileSize)}
+	}
+	fmt.Printf("match: %x\n", meta.Hash)
+	return nil
+}